@@ -2,11 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
 
+	"github.com/platform9/pcd-vm-saver/pkg/clock"
+	"github.com/platform9/pcd-vm-saver/pkg/config"
 	"github.com/platform9/pcd-vm-saver/pkg/log"
+	"github.com/platform9/pcd-vm-saver/pkg/openstack"
+	"github.com/platform9/pcd-vm-saver/pkg/result"
 	"github.com/platform9/pcd-vm-saver/pkg/slack"
 	"github.com/platform9/pcd-vm-saver/pkg/util"
 	"github.com/platform9/pcd-vm-saver/pkg/vmpoll"
@@ -31,168 +36,239 @@ func run(cmd *cobra.Command, args []string) {
 	zap.S().Infof("Version of pcd-vm-saver being used is: %s", util.Version)
 	zap.S().Info("starting scheduled tasks")
 
-	// Initialize Slack client
-	appToken := os.Getenv("SLACK_APP_TOKEN")
-	botToken := os.Getenv("SLACK_BOT_TOKEN")
-	if appToken == "" || botToken == "" {
-		zap.S().Warn("Slack tokens not found in environment variables. Slack integration will be disabled.")
-	} else {
-		client, err := slack.NewSlackClient(appToken, botToken)
-		if err != nil {
-			zap.S().Errorf("Failed to initialize Slack client: %v", err)
-		} else {
-			client.Start()
-			client.ListenForMentions()
-
-			ctx := cmd.Context()
-			if ctx == nil {
-				ctx = context.Background()
-			}
-			cmd.SetContext(context.WithValue(ctx, "slackClient", client))
-		}
+	clk := clock.New()
+	clouds, slackClient, err := setup(cmd, true)
+	if err != nil {
+		zap.S().Fatal(err)
 	}
 
+	// Resume the transitions interrupted by the previous run before scheduling new ones
+	runJob(slackClient, "Reconcile", func() ([]*result.RunResult, error) {
+		return vmpoll.ForClouds(clouds, clk, vmpoll.Reconcile(openstack.ReconcileOpts{Sleeps: true, Wakes: true}))
+	})
+
 	// Create schedule
 	schedule := cron.New(cron.WithChain(cron.SkipIfStillRunning(&CronSkipperLogger{})))
 	schedule.AddFunc("@every 1m", func() {
-		ctx := cmd.Context()
-		if ctx == nil {
-			zap.S().Warn("No context available, skipping Slack notification")
-			return
-		}
+		runJob(slackClient, "AutoSleepVM", func() ([]*result.RunResult, error) {
+			return vmpoll.ForClouds(clouds, clk, vmpoll.AutoSleepVM)
+		})
+	})
+	schedule.AddFunc("@every 2m", func() {
+		runJob(slackClient, "AutoAwakeVM", func() ([]*result.RunResult, error) {
+			return vmpoll.ForClouds(clouds, clk, vmpoll.AutoAwakeVM)
+		})
+	})
+	schedule.Start()
+	zap.S().Info("cron jobs scheduled")
 
-		client, ok := ctx.Value("slackClient").(*slack.SlackClient)
-		if !ok {
-			zap.S().Warn("Slack client not found in context, skipping notification")
-			return
-		}
+	zap.S().Info("pcd-vm-saver is running")
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	select {
+	case <-stop:
+		zap.S().Info("server stopping...")
+		schedule.Stop()
+	}
+}
 
-		channelID := os.Getenv("SLACK_CHANNEL_ID")
-		if channelID == "" {
-			zap.S().Warn("SLACK_CHANNEL_ID not set, skipping notification")
-			return
-		}
+// runOnce performs a single pass of the jobs selected by args[0], sleep, awake
+// or all, then exits. The interrupted transitions of the selected jobs are
+// resumed first, as at the startup of the service. An error is returned when a job or any VM failed.
+func runOnce(cmd *cobra.Command, args []string) error {
+	jobs := "all"
+	if len(args) == 1 {
+		jobs = args[0]
+	}
+	zap.S().Infof("Running pcd-vm-saver %s once (%s)", util.Version, jobs)
+
+	clk := clock.New()
+	clouds, slackClient, err := setup(cmd, false)
+	if err != nil {
+		return err
+	}
+	if slackClient != nil {
+		defer slackClient.Stop()
+	}
 
-		client.SendNotification(channelID, "info", "Starting AutoSleepVM task...")
+	type job struct {
+		name string
+		fn   func(*openstack.Cloud, clock.Clock) ([]*result.RunResult, error)
+	}
+	opts := openstack.ReconcileOpts{
+		Sleeps: jobs == "sleep" || jobs == "all",
+		Wakes:  jobs == "awake" || jobs == "all",
+	}
+	selected := []job{{"Reconcile", vmpoll.Reconcile(opts)}}
+	if opts.Sleeps {
+		selected = append(selected, job{"AutoSleepVM", vmpoll.AutoSleepVM})
+	}
+	if opts.Wakes {
+		selected = append(selected, job{"AutoAwakeVM", vmpoll.AutoAwakeVM})
+	}
 
-		successMsg, err := vmpoll.AutoSleepVM()
+	out := cmd.OutOrStdout()
+	var errs []error
+	failed := 0
+	for _, j := range selected {
+		results, err := runJob(slackClient, j.name, func() ([]*result.RunResult, error) {
+			return vmpoll.ForClouds(clouds, clk, j.fn)
+		})
 		if err != nil {
-			client.SendNotification(channelID, "failure", "AutoSleepVM task failed: "+err.Error())
-			zap.S().Errorf("AutoSleepVM failed: %v", err)
-		} else {
-			client.SendNotification(channelID, "success", successMsg)
-			zap.S().Info("AutoSleepVM completed successfully")
+			errs = append(errs, fmt.Errorf("%s: %w", j.name, err))
 		}
-	})
-	schedule.AddFunc("@every 2m", func() {
-		ctx := cmd.Context()
-		if ctx == nil {
-			zap.S().Warn("No context available, skipping Slack notification")
-			return
+		for _, res := range results {
+			fmt.Fprintln(out, res)
+			failed += res.Count(result.Failed)
 		}
-
-		client, ok := ctx.Value("slackClient").(*slack.SlackClient)
-		if !ok {
-			zap.S().Warn("Slack client not found in context, skipping notification")
-			return
-		}
-
-		channelID := os.Getenv("SLACK_CHANNEL_ID")
-		if channelID == "" {
-			zap.S().Warn("SLACK_CHANNEL_ID not set, skipping notification")
-			return
+		if len(results) > 1 {
+			fmt.Fprintln(out, result.Summary(results))
 		}
+	}
+	if failed > 0 {
+		errs = append(errs, fmt.Errorf("%d VM action(s) failed", failed))
+	}
+	return errors.Join(errs...)
+}
 
-		client.SendNotification(channelID, "info", "Starting AutoAwakeVM task...")
-
-		successMsg, err := vmpoll.AutoAwakeVM()
-		if err != nil {
-			client.SendNotification(channelID, "failure", "AutoAwakeVM task failed: "+err.Error())
-			zap.S().Errorf("AutoAwakeVM failed: %v", err)
-		} else {
-			client.SendNotification(channelID, "success", successMsg)
-			zap.S().Info("AutoAwakeVM completed successfully")
+// setup connects to the clouds and to Slack when configured, listen answers
+// the Slack mentions too. Slack failures only disable the notifications.
+func setup(cmd *cobra.Command, listen bool) ([]*openstack.Cloud, *slack.SlackClient, error) {
+	clouds, err := connectClouds()
+	if err != nil {
+		return nil, nil, err
+	}
+	if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+		zap.S().Info("Dry run, the planned actions are reported but no VM is changed")
+		for _, cloud := range clouds {
+			cloud.DryRun = true
 		}
-	})
-	schedule.Start()
-	zap.S().Info("cron jobs scheduled")
+	}
 
-	// Wrap the scheduled functions with notification handling
-	schedule.AddFunc("@every 1m", func() {
-		ctx := cmd.Context()
-		if ctx == nil {
-			zap.S().Warn("No context available, skipping Slack notification")
-			return
-		}
+	// Initialize Slack client
+	appToken := os.Getenv("SLACK_APP_TOKEN")
+	botToken := os.Getenv("SLACK_BOT_TOKEN")
+	if appToken == "" || botToken == "" {
+		zap.S().Warn("Slack tokens not found in environment variables. Slack integration will be disabled.")
+		return clouds, nil, nil
+	}
+	client, err := slack.NewSlackClient(appToken, botToken)
+	if err != nil {
+		zap.S().Errorf("Failed to initialize Slack client: %v", err)
+		return clouds, nil, nil
+	}
+	if listen {
+		client.Start()
+		client.ListenForMentions()
+	}
+	return clouds, client, nil
+}
 
-		client, ok := ctx.Value("slackClient").(*slack.SlackClient)
-		if !ok {
-			zap.S().Warn("Slack client not found in context, skipping notification")
-			return
-		}
+// connectClouds connects to every cloud of the configuration.
+func connectClouds() ([]*openstack.Cloud, error) {
+	cloudConfigs, err := config.CloudConfigs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
 
-		channelID := os.Getenv("SLACK_CHANNEL_ID")
-		if channelID == "" {
-			zap.S().Warn("SLACK_CHANNEL_ID not set, skipping notification")
-			return
+	var clouds []*openstack.Cloud
+	for _, cloudCfg := range cloudConfigs {
+		cloud, err := openstack.NewCloud(context.Background(), cloudCfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to OpenStack: %w", err)
 		}
+		clouds = append(clouds, cloud)
+	}
+	return clouds, nil
+}
 
-		client.SendNotification(channelID, "info", "Starting AutoSleepVM task...")
+// explain prints why the servers whose ID or name is args[0] will or won't
+// sleep, in every cloud they are found in.
+func explain(cmd *cobra.Command, args []string) error {
+	clouds, err := connectClouds()
+	if err != nil {
+		return err
+	}
 
-		successMsg, err := vmpoll.AutoSleepVM()
+	ctx := context.Background()
+	clk := clock.New()
+	found := false
+	for _, cloud := range clouds {
+		serverList, err := cloud.FindServers(ctx, args[0])
 		if err != nil {
-			client.SendNotification(channelID, "failure", "AutoSleepVM task failed: "+err.Error())
-			zap.S().Errorf("AutoSleepVM failed: %v", err)
-		} else {
-			client.SendNotification(channelID, "success", successMsg)
-			zap.S().Info("AutoSleepVM completed successfully")
+			return fmt.Errorf("cloud %s: %w", cloud.Name, err)
 		}
-	})
-
-	schedule.AddFunc("@every 2m", func() {
-		ctx := cmd.Context()
-		if ctx == nil {
-			zap.S().Warn("No context available, skipping Slack notification")
-			return
+		for _, server := range serverList {
+			explanation, err := cloud.Explain(ctx, clk, server)
+			if err != nil {
+				return fmt.Errorf("cloud %s: %w", cloud.Name, err)
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), explanation)
+			found = true
 		}
+	}
+	if !found {
+		return fmt.Errorf("no server with ID or name %q found", args[0])
+	}
+	return nil
+}
 
-		client, ok := ctx.Value("slackClient").(*slack.SlackClient)
-		if !ok {
-			zap.S().Warn("Slack client not found in context, skipping notification")
+// runJob runs a sleep/awake job, logs its result and notifies Slack when
+// configured. The results and error of the job are returned.
+func runJob(client *slack.SlackClient, name string, job func() ([]*result.RunResult, error)) ([]*result.RunResult, error) {
+	channelID := os.Getenv("SLACK_CHANNEL_ID")
+	notify := func(status, message string) {
+		if client == nil {
 			return
 		}
-
-		channelID := os.Getenv("SLACK_CHANNEL_ID")
 		if channelID == "" {
 			zap.S().Warn("SLACK_CHANNEL_ID not set, skipping notification")
 			return
 		}
+		if err := client.SendNotification(channelID, status, message); err != nil {
+			zap.S().Errorf("Failed to send Slack notification: %v", err)
+		}
+	}
 
-		client.SendNotification(channelID, "info", "Starting AutoAwakeVM task...")
+	notify("info", fmt.Sprintf("Starting %s task...", name))
 
-		successMsg, err := vmpoll.AutoAwakeVM()
-		if err != nil {
-			client.SendNotification(channelID, "failure", "AutoAwakeVM task failed: "+err.Error())
-			zap.S().Errorf("AutoAwakeVM failed: %v", err)
+	// Errors only concern the clouds that could not be processed, the results
+	// of the other clouds are still reported.
+	results, err := job()
+	if err != nil {
+		notify("failure", fmt.Sprintf("%s task failed: %v", name, err))
+		zap.S().Errorf("%s failed: %v", name, err)
+	}
+
+	// One notification per project of each cloud
+	for _, res := range results {
+		if res.PartialFailure() {
+			notify("failure", res.String())
+			zap.S().Warnf("%s completed with %d failed VM(s) in project %q", name, res.Count(result.Failed), res.Project)
 		} else {
-			client.SendNotification(channelID, "success", successMsg)
-			zap.S().Info("AutoAwakeVM completed successfully")
+			notify("success", res.String())
+			zap.S().Infof("%s completed successfully in project %q", name, res.Project)
 		}
-	})
+		for _, vm := range res.VMs {
+			zap.S().Infow(name+" VM result", "name", vm.Name, "id", vm.ID, "project", vm.Project, "action", vm.Action,
+				"outcome", vm.Outcome, "reason", vm.Reason, "previous_status", vm.PreviousStatus, "new_status", vm.NewStatus,
+				"attempts", vm.Attempts, "duration", vm.Duration, "cloud", vm.Cloud, "region", vm.Region)
+		}
+	}
 
-	zap.S().Info("pcd-vm-saver is running")
-	stop := make(chan os.Signal)
-	signal.Notify(stop, os.Interrupt)
-	select {
-	case <-stop:
-		zap.S().Info("server stopping...")
-		schedule.Stop()
+	if len(results) > 1 {
+		summary := result.Summary(results)
+		notify("done", summary)
+		zap.S().Info(summary)
 	}
+	return results, err
 }
 
 func main() {
 	cmd := buildCmds()
-	cmd.Execute()
+	if err := cmd.Execute(); err != nil {
+		os.Exit(1)
+	}
 }
 
 func buildCmds() *cobra.Command {
@@ -202,6 +278,32 @@ func buildCmds() *cobra.Command {
 		Long:  "pcd-vm-saver helps handling VMs efficiently by hibernating and awaking them",
 		Run:   run,
 	}
+	rootCmd.Flags().Bool("dry-run", false, "Evaluate the schedules and report the planned actions without changing any VM")
+
+	runCmd := &cobra.Command{
+		Use:   "run [--once [sleep|awake|all]]",
+		Short: "Run pcd-vm-saver, or a single pass of its jobs",
+		Long: "Run pcd-vm-saver as a service, the same as without a command. With --once, perform a single pass of the sleep job, " +
+			"the awake job or both (the default), print the results and exit, e.g. from an external scheduler. " +
+			"The exit code is non-zero when any job or VM failed.",
+		ValidArgs:    []string{"sleep", "awake", "all"},
+		SilenceUsage: true,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if once, _ := cmd.Flags().GetBool("once"); !once {
+				return cobra.NoArgs(cmd, args)
+			}
+			return cobra.MatchAll(cobra.MaximumNArgs(1), cobra.OnlyValidArgs)(cmd, args)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if once, _ := cmd.Flags().GetBool("once"); once {
+				return runOnce(cmd, args)
+			}
+			run(cmd, args)
+			return nil
+		},
+	}
+	runCmd.Flags().Bool("once", false, "Perform a single pass and exit")
+	runCmd.Flags().Bool("dry-run", false, "Evaluate the schedules and report the planned actions without changing any VM")
 
 	versionCmd := &cobra.Command{
 		Use:   "version",
@@ -212,7 +314,39 @@ func buildCmds() *cobra.Command {
 		},
 	}
 
-	rootCmd.AddCommand(versionCmd)
+	explainCmd := &cobra.Command{
+		Use:   "explain <server-id|name>",
+		Short: "Explain why a VM will or won't sleep",
+		Long:  "Fetch the VM, run all the policy, override and exclusion checks and print each verdict along with the next planned sleep and wake times. Nothing is changed on the VM.",
+		Args:  cobra.ExactArgs(1),
+		RunE:  explain,
+	}
+
+	planCmd := &cobra.Command{
+		Use:   "plan",
+		Short: "Print the VMs that would be slept or woken",
+		Long:  "Evaluate all the policies and print which VMs would be slept or woken right now and at what times over the next hours. No VM is changed.",
+		Args:  cobra.NoArgs,
+		RunE:  plan,
+	}
+	planCmd.Flags().Int("hours", 24, "Number of hours to plan ahead")
+	planCmd.Flags().StringP("output", "o", "table", "Output format, table or json")
+
+	simulateCmd := &cobra.Command{
+		Use:   "simulate",
+		Short: "Simulate the schedules over a time range",
+		Long:  "Replay the schedules over a time range against the current VMs, or a saved inventory, and print the timeline of the sleeps and wakes along with the projected vCPU and RAM hours saved. No VM is changed.",
+		Args:  cobra.NoArgs,
+		RunE:  simulate,
+	}
+	simulateCmd.Flags().String("from", "now", "Start of the simulation: now, +<duration>, an RFC3339 time or a local date")
+	simulateCmd.Flags().String("to", "+168h", "End of the simulation: now, +<duration>, an RFC3339 time or a local date")
+	simulateCmd.Flags().String("cloud", "", "Only simulate the cloud with this name")
+	simulateCmd.Flags().String("inventory", "", "Simulate the servers saved in this JSON file instead of the current ones")
+	simulateCmd.Flags().String("save-inventory", "", "Save the current servers to this JSON file")
+	simulateCmd.Flags().StringP("output", "o", "table", "Output format, table or json")
+
+	rootCmd.AddCommand(runCmd, versionCmd, explainCmd, planCmd, simulateCmd)
 	return rootCmd
 }
 
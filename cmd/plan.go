@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/platform9/pcd-vm-saver/pkg/clock"
+	"github.com/platform9/pcd-vm-saver/pkg/config"
+	"github.com/platform9/pcd-vm-saver/pkg/openstack"
+	"github.com/spf13/cobra"
+)
+
+// plan prints the sleeps and wakes planned over the next hours in every cloud,
+// without acting on any server.
+func plan(cmd *cobra.Command, args []string) error {
+	hours, _ := cmd.Flags().GetInt("hours")
+	output, _ := cmd.Flags().GetString("output")
+	if hours <= 0 {
+		return fmt.Errorf("--hours must be positive")
+	}
+	if err := checkOutput(output); err != nil {
+		return err
+	}
+
+	clouds, err := connectClouds()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	clk := clock.New()
+	events := []openstack.Event{}
+	for _, cloud := range clouds {
+		cloud.DryRun = true
+		cloudEvents, err := cloud.Plan(ctx, clk, time.Duration(hours)*time.Hour)
+		if err != nil {
+			return fmt.Errorf("cloud %s: %w", cloud.Name, err)
+		}
+		events = append(events, cloudEvents...)
+	}
+
+	if output == "json" {
+		encoder := json.NewEncoder(cmd.OutOrStdout())
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(events)
+	}
+	return printEvents(cmd.OutOrStdout(), events)
+}
+
+// printEvents renders the events as a table.
+func printEvents(out io.Writer, events []openstack.Event) error {
+	if len(events) == 0 {
+		_, err := fmt.Fprintln(out, "No VM to sleep or wake")
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "WHEN\tCLOUD\tPROJECT\tVM\tID\tACTION\tUNTIL\tPOLICY")
+	for _, e := range events {
+		when := e.At.Format(time.RFC3339)
+		if e.Now {
+			when = "now"
+		}
+		until := "-"
+		if !e.Until.IsZero() {
+			until = e.Until.Format(time.RFC3339)
+		}
+		policy := e.Policy
+		if policy == "" {
+			policy = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", when, e.Cloud, e.Project, e.Server, e.ID, e.Action, until, policy)
+	}
+	return w.Flush()
+}
+
+// simulate replays the schedules over a time range against the current
+// servers, or a saved inventory, and prints the timeline of the sleeps and
+// wakes along with the resources they release.
+func simulate(cmd *cobra.Command, args []string) error {
+	flags := cmd.Flags()
+	fromFlag, _ := flags.GetString("from")
+	toFlag, _ := flags.GetString("to")
+	cloudName, _ := flags.GetString("cloud")
+	inventory, _ := flags.GetString("inventory")
+	saveInventory, _ := flags.GetString("save-inventory")
+	output, _ := flags.GetString("output")
+	if err := checkOutput(output); err != nil {
+		return err
+	}
+	if inventory != "" && saveInventory != "" {
+		return fmt.Errorf("--inventory and --save-inventory can't be used together")
+	}
+
+	clk := clock.New()
+	now := clk.Now()
+	from, err := parseTime(fromFlag, now)
+	if err != nil {
+		return fmt.Errorf("invalid --from: %w", err)
+	}
+	to, err := parseTime(toFlag, now)
+	if err != nil {
+		return fmt.Errorf("invalid --to: %w", err)
+	}
+
+	cloudConfigs, err := config.CloudConfigs()
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	if cloudName != "" {
+		cloudConfigs = slices.DeleteFunc(cloudConfigs, func(cfg openstack.CloudConfig) bool { return cfg.Name != cloudName })
+		if len(cloudConfigs) == 0 {
+			return fmt.Errorf("no cloud named %q in the configuration", cloudName)
+		}
+	}
+	if (inventory != "" || saveInventory != "") && len(cloudConfigs) != 1 {
+		return fmt.Errorf("an inventory holds the servers of one cloud, select it with --cloud")
+	}
+
+	ctx := context.Background()
+	sim := &openstack.Simulation{From: from, To: to}
+	for _, cloudCfg := range cloudConfigs {
+		var cloud *openstack.Cloud
+		var serverList []servers.Server
+		if inventory != "" {
+			cloud = openstack.NewOfflineCloud(cloudCfg)
+			if serverList, err = openstack.LoadInventory(inventory); err != nil {
+				return err
+			}
+		} else {
+			if cloud, err = openstack.NewCloud(ctx, cloudCfg); err != nil {
+				return fmt.Errorf("failed to connect to OpenStack: %w", err)
+			}
+			cloud.DryRun = true
+			if serverList, err = cloud.Servers(ctx, clk); err != nil {
+				return fmt.Errorf("cloud %s: %w", cloud.Name, err)
+			}
+			if saveInventory != "" {
+				if err := openstack.SaveInventory(saveInventory, serverList); err != nil {
+					return err
+				}
+			}
+		}
+
+		cloudSim, err := cloud.Simulate(ctx, clk, serverList, from, to)
+		if err != nil {
+			return fmt.Errorf("cloud %s: %w", cloud.Name, err)
+		}
+		sim.Add(cloudSim)
+	}
+
+	if output == "json" {
+		encoder := json.NewEncoder(cmd.OutOrStdout())
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(struct {
+			*openstack.Simulation
+			Total openstack.Savings `json:"total"`
+		}{sim, sim.Total()})
+	}
+	out := cmd.OutOrStdout()
+	fmt.Fprintf(out, "Simulation from %s to %s\n\n", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	if err := printEvents(out, sim.Events); err != nil {
+		return err
+	}
+	fmt.Fprintln(out)
+	return printSavings(out, sim)
+}
+
+// printSavings renders the resources released by each server as a table.
+func printSavings(out io.Writer, sim *openstack.Simulation) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CLOUD\tPROJECT\tVM\tID\tSLEEPS\tASLEEP HOURS\tVCPU HOURS\tRAM GB HOURS")
+	row := func(s openstack.Savings) {
+		vcpu, ram := fmt.Sprintf("%.1f", s.VCPUHours), fmt.Sprintf("%.1f", s.RAMGBHours)
+		if s.UnknownSize > 0 && s.Server != "" {
+			vcpu, ram = "?", "?"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%.1f\t%s\t%s\n", s.Cloud, s.Project, s.Server, s.ID, s.Sleeps, s.AsleepHours, vcpu, ram)
+	}
+	for _, savings := range sim.Savings {
+		row(savings)
+	}
+	total := sim.Total()
+	total.Cloud = "TOTAL"
+	row(total)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if total.UnknownSize > 0 {
+		_, err := fmt.Fprintf(out, "\nThe flavor size of %d VM(s) is unknown, their resources are not counted\n", total.UnknownSize)
+		return err
+	}
+	return nil
+}
+
+func checkOutput(output string) error {
+	if output != "table" && output != "json" {
+		return fmt.Errorf("unknown output %q, expected table or json", output)
+	}
+	return nil
+}
+
+// parseTime parses "now", a duration relative to now such as "+48h", an
+// RFC3339 time or a local "2006-01-02T15:04" time or "2006-01-02" date.
+func parseTime(value string, now time.Time) (time.Time, error) {
+	if value == "now" {
+		return now, nil
+	}
+	if offset, ok := strings.CutPrefix(value, "+"); ok {
+		d, err := time.ParseDuration(offset)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return now.Add(d), nil
+	}
+	// The schedules are evaluated in local time, as by the service
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.In(time.Local), nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is neither now, +<duration>, an RFC3339 time nor a date", value)
+}
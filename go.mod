@@ -3,11 +3,14 @@ module github.com/platform9/pcd-vm-saver
 go 1.24.1
 
 require (
+	github.com/expr-lang/expr v1.17.6
 	github.com/gophercloud/gophercloud/v2 v2.7.0
 	github.com/robfig/cron/v3 v3.0.1
 	github.com/slack-go/slack v0.17.2
 	github.com/spf13/cobra v1.9.1
 	go.uber.org/zap v1.27.0
+	golang.org/x/time v0.12.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -15,4 +18,5 @@ require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/spf13/pflag v1.0.6 // indirect
 	go.uber.org/multierr v1.10.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
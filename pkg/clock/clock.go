@@ -0,0 +1,111 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock abstracts time so that the schedule evaluation and polling code can be
+// driven by a fake clock when simulating or testing schedules.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+// New returns a Clock backed by the system time.
+func New() Clock {
+	return realClock{}
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// FakeClock is a manually driven Clock. Time only passes when Advance or Set
+// is called, which fires the channels of the After calls that are due, so
+// whole days of schedule behavior can be replayed in milliseconds.
+type FakeClock struct {
+	mu      sync.Mutex
+	cond    *sync.Cond // Signaled when a waiter is added
+	now     time.Time
+	waiters []waiter
+}
+
+type waiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// NewFake returns a FakeClock set to the given time. The location of t is kept,
+// which allows simulating schedules across DST changes.
+func NewFake(t time.Time) *FakeClock {
+	f := &FakeClock{now: t}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+func (f *FakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// After returns a channel receiving the time once the clock has been moved
+// d forward. A non-positive d fires immediately.
+func (f *FakeClock) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- f.now
+		return ch
+	}
+	f.waiters = append(f.waiters, waiter{at: f.now.Add(d), ch: ch})
+	f.cond.Broadcast()
+	return ch
+}
+
+// Advance moves the clock forward by d and returns the new time.
+func (f *FakeClock) Advance(d time.Duration) time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.set(f.now.Add(d))
+	return f.now
+}
+
+// Set moves the clock to t.
+func (f *FakeClock) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.set(t)
+}
+
+// BlockUntil waits until n After calls are pending, so that a test knows the
+// code under test is waiting before it advances the clock.
+func (f *FakeClock) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.waiters) < n {
+		f.cond.Wait()
+	}
+}
+
+// set moves the clock to t and fires the waiters that are due, f.mu is held.
+func (f *FakeClock) set(t time.Time) {
+	f.now = t
+	pending := f.waiters[:0]
+	for _, w := range f.waiters {
+		if w.at.After(t) {
+			pending = append(pending, w)
+			continue
+		}
+		w.ch <- t
+	}
+	f.waiters = pending
+}
@@ -0,0 +1,83 @@
+package clock
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC)
+
+func fired(ch <-chan time.Time) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestFakeClockAfter(t *testing.T) {
+	clk := NewFake(start)
+	ch := clk.After(time.Minute)
+	if fired(ch) {
+		t.Fatal("After fired before the clock moved")
+	}
+	if !clk.Now().Equal(start) {
+		t.Fatalf("After moved the clock to %s", clk.Now())
+	}
+
+	clk.Advance(59 * time.Second)
+	if fired(ch) {
+		t.Fatal("After fired 1s early")
+	}
+	clk.Advance(time.Second)
+	select {
+	case at := <-ch:
+		if want := start.Add(time.Minute); !at.Equal(want) {
+			t.Errorf("After fired with %s, want %s", at, want)
+		}
+	default:
+		t.Fatal("After did not fire once due")
+	}
+}
+
+func TestFakeClockAfterNonPositive(t *testing.T) {
+	clk := NewFake(start)
+	if !fired(clk.After(0)) {
+		t.Error("After(0) did not fire immediately")
+	}
+}
+
+func TestFakeClockSetFiresDueWaiters(t *testing.T) {
+	clk := NewFake(start)
+	soon, later := clk.After(time.Minute), clk.After(time.Hour)
+	clk.Set(start.Add(30 * time.Minute))
+	if !fired(soon) {
+		t.Error("the waiter due was not fired")
+	}
+	if fired(later) {
+		t.Error("the waiter not due was fired")
+	}
+}
+
+// Concurrent waiters share the clock, it must only move as far as advanced.
+func TestFakeClockConcurrentWaiters(t *testing.T) {
+	clk := NewFake(start)
+	const n = 5
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-clk.After(time.Minute)
+		}()
+	}
+
+	clk.BlockUntil(n)
+	clk.Advance(time.Minute)
+	wg.Wait()
+	if want := start.Add(time.Minute); !clk.Now().Equal(want) {
+		t.Errorf("clock at %s after %d concurrent waits, want %s", clk.Now(), n, want)
+	}
+}
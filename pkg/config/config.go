@@ -0,0 +1,313 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/config/clouds"
+	"github.com/platform9/pcd-vm-saver/pkg/openstack"
+	"github.com/platform9/pcd-vm-saver/pkg/selector"
+	"github.com/platform9/pcd-vm-saver/pkg/util"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the pcd-vm-saver configuration file, its path is read from the
+// VMSAVER_CONFIG environment variable.
+type Config struct {
+	Clouds []Cloud `yaml:"clouds"`
+	// Exclusion rules applied to every cloud
+	Exclusions []Exclusion `yaml:"exclusions"`
+	// Schedule policies applied to every cloud
+	Policies []Policy `yaml:"policies"`
+}
+
+// Cloud is one cloud region managed by pcd-vm-saver.
+type Cloud struct {
+	Name string `yaml:"name"`
+	// Entry of clouds.yaml holding the credentials. When empty the OS_*
+	// environment variables are used.
+	Cloud  string `yaml:"cloud"`
+	Region string `yaml:"region"`
+
+	Workers  int     `yaml:"workers"`
+	APIRate  float64 `yaml:"api_rate"`
+	APIBurst int     `yaml:"api_burst"`
+
+	OptInTags  []string `yaml:"opt_in_tags"`
+	AllTenants bool     `yaml:"all_tenants"`
+	Projects   []string `yaml:"projects"`
+
+	Lock          bool `yaml:"lock"`
+	ShelveShutoff bool `yaml:"shelve_shutoff"`
+	// RFC3339 time until which legacy sleeping VMs are adopted
+	AdoptLegacyUntil string `yaml:"adopt_legacy_until"`
+
+	// Exclusion rules applied to this cloud only, after the global ones
+	Exclusions []Exclusion `yaml:"exclusions"`
+	// Schedule policies of this cloud only, evaluated before the global ones
+	Policies []Policy `yaml:"policies"`
+}
+
+// Policy applies a sleep schedule to the VMs matched by its selector, e.g.
+// "env in (dev,test), team=qa, !critical". The selector is matched against
+// the VM metadata and tags.
+type Policy struct {
+	Name     string `yaml:"name"`
+	Selector string `yaml:"selector"`
+	Expr     string `yaml:"expr"`
+
+	// Schedule, zone and sleep_time are shorthands for the zone and hours
+	// types. Other types are the registered policy kinds.
+	Type        string `yaml:"type"`
+	Value       string `yaml:"value"`
+	Zone        string `yaml:"zone"`       // same values as sleep_zone
+	SleepTime   string `yaml:"sleep_time"` // hours, as in sleep_time
+	RAMPreserve bool   `yaml:"ram_preserve"`
+}
+
+// kind returns the policy kind and value of the schedule.
+func (p Policy) kind() (kind, value string, err error) {
+	set := 0
+	if p.Type != "" {
+		kind, value = p.Type, p.Value
+		set++
+	}
+	if p.Zone != "" {
+		kind, value = "zone", p.Zone
+		set++
+	}
+	if p.SleepTime != "" {
+		kind, value = "hours", p.SleepTime
+		set++
+	}
+	if set != 1 {
+		return "", "", fmt.Errorf("exactly one of type, zone and sleep_time must be set")
+	}
+	return kind, value, nil
+}
+
+// Exclusion is a rule keeping the matching VMs from ever being put to sleep.
+// All the set fields must match, e.g. a flavor in a given project.
+type Exclusion struct {
+	Name              string            `yaml:"name"`
+	Flavors           []string          `yaml:"flavors"`     // flavor name glob patterns
+	ExtraSpecs        map[string]string `yaml:"extra_specs"` // values are glob patterns
+	Images            []string          `yaml:"images"`
+	NameRegex         string            `yaml:"name_regex"`
+	AvailabilityZones []string          `yaml:"availability_zones"`
+	ServerGroups      []string          `yaml:"server_groups"` // IDs or names
+	Projects          []string          `yaml:"projects"`      // all the projects when empty
+	Expr              string            `yaml:"expr"`
+}
+
+// Load reads the configuration file at path.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	if len(cfg.Clouds) == 0 {
+		return nil, fmt.Errorf("config file %s does not list any cloud", path)
+	}
+	return &cfg, nil
+}
+
+// CloudConfigs returns the configuration of every cloud to manage. Without a
+// configuration file the single cloud described by the environment is managed.
+func CloudConfigs() ([]openstack.CloudConfig, error) {
+	path := os.Getenv(util.ConfigEnv)
+	if path == "" {
+		return []openstack.CloudConfig{openstack.CloudConfigFromEnv()}, nil
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	globalExclusions, err := exclusionRules(cfg.Exclusions)
+	if err != nil {
+		return nil, err
+	}
+	globalPolicies, err := schedulePolicies(cfg.Policies)
+	if err != nil {
+		return nil, err
+	}
+
+	var cloudConfigs []openstack.CloudConfig
+	names := map[string]bool{}
+	for i, entry := range cfg.Clouds {
+		cloudCfg, err := entry.cloudConfig()
+		if err != nil {
+			return nil, fmt.Errorf("cloud #%d: %w", i+1, err)
+		}
+		cloudExclusions, err := exclusionRules(entry.Exclusions)
+		if err != nil {
+			return nil, fmt.Errorf("cloud #%d: %w", i+1, err)
+		}
+		cloudCfg.Exclusions = append(slices.Clone(globalExclusions), cloudExclusions...)
+		cloudPolicies, err := schedulePolicies(entry.Policies)
+		if err != nil {
+			return nil, fmt.Errorf("cloud #%d: %w", i+1, err)
+		}
+		cloudCfg.Policies = append(cloudPolicies, globalPolicies...)
+		if names[cloudCfg.Name] {
+			return nil, fmt.Errorf("cloud #%d: duplicate cloud name %q", i+1, cloudCfg.Name)
+		}
+		names[cloudCfg.Name] = true
+		cloudConfigs = append(cloudConfigs, cloudCfg)
+	}
+	return cloudConfigs, nil
+}
+
+func (c Cloud) cloudConfig() (openstack.CloudConfig, error) {
+	// Start from the environment so that unset fields keep their defaults.
+	cloudCfg := openstack.CloudConfigFromEnv()
+
+	if c.Cloud != "" {
+		authOpts, endpointOpts, _, err := clouds.Parse(clouds.WithCloudName(c.Cloud), clouds.WithRegion(c.Region))
+		if err != nil {
+			return cloudCfg, fmt.Errorf("failed to read %s from clouds.yaml: %w", c.Cloud, err)
+		}
+		cloudCfg.AuthOptions = authOpts
+		cloudCfg.Region = endpointOpts.Region
+		cloudCfg.ProjectID = authOpts.TenantID
+	}
+	if c.Region != "" {
+		cloudCfg.Region = c.Region
+	}
+
+	// Default the name to <cloud>/<region>
+	cloudCfg.Name = c.Name
+	if cloudCfg.Name == "" {
+		var parts []string
+		for _, part := range []string{c.Cloud, cloudCfg.Region} {
+			if part != "" {
+				parts = append(parts, part)
+			}
+		}
+		cloudCfg.Name = strings.Join(parts, "/")
+	}
+	if cloudCfg.Name == "" {
+		return cloudCfg, fmt.Errorf("either name, cloud or region must be set")
+	}
+
+	if c.Workers > 0 {
+		cloudCfg.Workers = c.Workers
+	}
+	if c.APIRate > 0 {
+		cloudCfg.RateLimit = c.APIRate
+	}
+	if c.APIBurst > 0 {
+		cloudCfg.RateBurst = c.APIBurst
+	}
+	if len(c.OptInTags) > 0 {
+		cloudCfg.OptInTags = c.OptInTags
+	}
+	if c.AllTenants {
+		cloudCfg.AllTenants = true
+	}
+	if len(c.Projects) > 0 {
+		cloudCfg.Projects = c.Projects
+	}
+	if c.Lock {
+		cloudCfg.Lock = true
+	}
+	if c.ShelveShutoff {
+		cloudCfg.ShelveShutoff = true
+	}
+	if c.AdoptLegacyUntil != "" {
+		until, err := time.Parse(time.RFC3339, c.AdoptLegacyUntil)
+		if err != nil {
+			return cloudCfg, fmt.Errorf("invalid adopt_legacy_until: %w", err)
+		}
+		cloudCfg.AdoptLegacyUntil = until
+	}
+	return cloudCfg, nil
+}
+
+func exclusionRules(exclusions []Exclusion) ([]openstack.ExclusionRule, error) {
+	var rules []openstack.ExclusionRule
+	for i, e := range exclusions {
+		rule := openstack.ExclusionRule{
+			Name:              e.Name,
+			Flavors:           e.Flavors,
+			ExtraSpecs:        e.ExtraSpecs,
+			Images:            e.Images,
+			AvailabilityZones: e.AvailabilityZones,
+			ServerGroups:      e.ServerGroups,
+			Projects:          e.Projects,
+		}
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("exclusion #%d", i+1)
+		}
+		if e.NameRegex != "" {
+			re, err := regexp.Compile(e.NameRegex)
+			if err != nil {
+				return nil, fmt.Errorf("exclusion rule %q: invalid name_regex: %w", rule.Name, err)
+			}
+			rule.NameRegex = re
+		}
+		if e.Expr != "" {
+			exprRule, err := openstack.CompileExprRule(e.Expr)
+			if err != nil {
+				return nil, fmt.Errorf("exclusion rule %q: %w", rule.Name, err)
+			}
+			rule.Expr = exprRule
+		}
+		if err := rule.Validate(); err != nil {
+			return nil, fmt.Errorf("exclusion rule %q: %w", rule.Name, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func schedulePolicies(policies []Policy) ([]openstack.SchedulePolicy, error) {
+	var schedules []openstack.SchedulePolicy
+	for i, p := range policies {
+		name := p.Name
+		if name == "" {
+			name = fmt.Sprintf("policy #%d", i+1)
+		}
+		sel, err := selector.Parse(p.Selector)
+		if err != nil {
+			return nil, fmt.Errorf("policy %q: %w", name, err)
+		}
+		kind, value, err := p.kind()
+		if err != nil {
+			return nil, fmt.Errorf("policy %q: %w", name, err)
+		}
+		schedule, err := openstack.NewPolicy(kind, value)
+		if err != nil {
+			return nil, fmt.Errorf("policy %q: %w", name, err)
+		}
+		policy := openstack.SchedulePolicy{
+			Name:        name,
+			Selector:    sel,
+			Policy:      schedule,
+			SuspendMode: p.RAMPreserve,
+		}
+		if p.Expr != "" {
+			exprRule, err := openstack.CompileExprRule(p.Expr)
+			if err != nil {
+				return nil, fmt.Errorf("policy %q: %w", name, err)
+			}
+			policy.Expr = exprRule
+		}
+		if err := policy.Validate(); err != nil {
+			return nil, fmt.Errorf("policy %q: %w", name, err)
+		}
+		schedules = append(schedules, policy)
+	}
+	return schedules, nil
+}
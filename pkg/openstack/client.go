@@ -0,0 +1,268 @@
+package openstack
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack"
+	"github.com/gophercloud/gophercloud/v2/openstack/identity/v3/tokens"
+	"github.com/platform9/pcd-vm-saver/pkg/util"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+// CloudConfig holds everything needed to connect to one cloud region.
+type CloudConfig struct {
+	Name        string
+	AuthOptions gophercloud.AuthOptions
+	Region      string
+	ProjectID   string
+
+	// Number of VMs processed concurrently during sleep/awake runs.
+	Workers int
+	// API requests per second allowed against the cloud, and the burst size.
+	RateLimit float64
+	RateBurst int
+
+	// When set, only servers tagged with at least one of these Nova tags are
+	// listed. Server tags require compute microversion 2.26.
+	OptInTags []string
+
+	// Admin mode: manage the servers of all the projects, or only of the given
+	// projects when Projects is set, instead of the authenticated project only.
+	AllTenants bool
+	Projects   []string
+
+	// Lock the servers while they are asleep so that nobody else acts on them.
+	Lock bool
+
+	// Shelve the SHUTOFF servers with a schedule, not only the ACTIVE ones.
+	ShelveShutoff bool
+
+	// Until this time, the servers put to sleep by a release predating the
+	// ownership marker are adopted and awakened. Never when zero.
+	AdoptLegacyUntil time.Time
+
+	// Rules keeping servers from ever being put to sleep.
+	Exclusions []ExclusionRule
+	// Schedules applied to the servers without a schedule in their metadata,
+	// the first policy selecting a server applies.
+	Policies []SchedulePolicy
+}
+
+// Cloud is an authenticated compute client shared by all the operations on one
+// cloud region. Every request goes through the cloud's API rate limiter.
+type Cloud struct {
+	Name      string
+	Region    string
+	ProjectID string
+	Workers   int
+	// Compute features available with the negotiated microversion
+	Features Features
+	// Evaluate the schedules and report the planned actions without acting on any server
+	DryRun bool
+
+	compute       *gophercloud.ServiceClient
+	optInTags     []string
+	allTenants    bool
+	projects      []string
+	lock          bool
+	shelveShutoff bool
+	adoptUntil    time.Time
+	exclusions    []ExclusionRule
+	policies      []SchedulePolicy
+	inventory     *Inventory
+
+	// Servers being acted upon by a sleep or awake run
+	inFlightMu sync.Mutex
+	inFlight   map[string]bool
+}
+
+// CloudConfigFromEnv builds the CloudConfig from the OS_* and VMSAVER_*
+// environment variables.
+func CloudConfigFromEnv() CloudConfig {
+	return CloudConfig{
+		Name: "default",
+		AuthOptions: gophercloud.AuthOptions{
+			IdentityEndpoint: os.Getenv("OS_AUTH_URL"),
+			Username:         os.Getenv("OS_USERNAME"),
+			Password:         os.Getenv("OS_PASSWORD"),
+			DomainName:       os.Getenv("OS_USER_DOMAIN_NAME"),
+			// Either of Domain Name or Domain ID is only required not both.
+			TenantName: os.Getenv("OS_PROJECT_NAME"),
+			TenantID:   os.Getenv("OS_PROJECT_ID"),
+		},
+		Region:           os.Getenv("OS_REGION_NAME"),
+		ProjectID:        os.Getenv("OS_PROJECT_ID"),
+		Workers:          envInt(util.WorkersEnv, util.DefaultWorkers),
+		RateLimit:        envFloat(util.APIRateEnv, util.DefaultAPIRate),
+		RateBurst:        envInt(util.APIBurstEnv, util.DefaultAPIBurst),
+		OptInTags:        envList(util.OptInTagsEnv),
+		AllTenants:       os.Getenv(util.AllTenantsEnv) == "true",
+		Projects:         envList(util.ProjectsEnv),
+		Lock:             os.Getenv(util.LockEnv) == "true",
+		ShelveShutoff:    os.Getenv(util.ShelveShutoffEnv) == "true",
+		AdoptLegacyUntil: envTime(util.AdoptLegacyUntilEnv),
+	}
+}
+
+// NewCloud authenticates against the cloud and returns a rate limited compute client.
+func NewCloud(ctx context.Context, cfg CloudConfig) (*Cloud, error) {
+	provider, err := openstack.NewClient(cfg.AuthOptions.IdentityEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create provider client for cloud %s: %w", cfg.Name, err)
+	}
+	provider.HTTPClient = http.Client{
+		Transport: &rateLimitedTransport{
+			limiter: rate.NewLimiter(rate.Limit(cfg.RateLimit), max(cfg.RateBurst, 1)),
+			next:    http.DefaultTransport,
+		},
+	}
+
+	// The client lives as long as the process, so let gophercloud renew the token.
+	authOpts := cfg.AuthOptions
+	authOpts.AllowReauth = true
+
+	// Authenticate
+	if err := openstack.Authenticate(ctx, provider, authOpts); err != nil {
+		return nil, fmt.Errorf("authentication failed for cloud %s: %w", cfg.Name, err)
+	}
+
+	// Quotas are looked up by project ID, resolve it when only the name was given.
+	projectID := cfg.ProjectID
+	if projectID == "" {
+		if authResult, ok := provider.GetAuthResult().(tokens.CreateResult); ok {
+			if project, err := authResult.ExtractProject(); err == nil && project != nil {
+				projectID = project.ID
+			}
+		}
+	}
+
+	// Create compute client
+	client, err := openstack.NewComputeV2(provider, gophercloud.EndpointOpts{
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create compute client for cloud %s: %w", cfg.Name, err)
+	}
+
+	features, err := negotiateMicroversion(ctx, client)
+	if err != nil {
+		zap.S().Warnf("Cloud %s: %v, using the base compute microversion", cfg.Name, err)
+	}
+	if len(cfg.OptInTags) > 0 && !features.Tags {
+		return nil, fmt.Errorf("cloud %s: opt-in tags require compute microversion %s", cfg.Name, tagsMicroversion)
+	}
+	if !features.EmbeddedFlavor && slices.ContainsFunc(cfg.Exclusions, func(rule ExclusionRule) bool {
+		return len(rule.Flavors) > 0 || len(rule.ExtraSpecs) > 0
+	}) {
+		zap.S().Warnf("Cloud %s: flavor names and extra specs require compute microversion %s, flavor exclusion rules match flavor IDs only",
+			cfg.Name, embeddedFlavorMicroversion)
+	}
+
+	zap.S().Infof("Connected to cloud %s (region %q) with %d workers and %.1f API requests/s",
+		cfg.Name, cfg.Region, cfg.Workers, cfg.RateLimit)
+
+	cloud := newCloud(cfg)
+	cloud.ProjectID = projectID
+	cloud.Features = features
+	cloud.compute = client
+	return cloud, nil
+}
+
+// NewOfflineCloud returns a cloud evaluating the schedules and rules of cfg
+// without connecting to it, e.g. to simulate a saved inventory. Nothing
+// needing the compute API can be done with it.
+func NewOfflineCloud(cfg CloudConfig) *Cloud {
+	return newCloud(cfg)
+}
+
+func newCloud(cfg CloudConfig) *Cloud {
+	cloud := &Cloud{
+		Name:          cfg.Name,
+		Region:        cfg.Region,
+		ProjectID:     cfg.ProjectID,
+		Workers:       max(cfg.Workers, 1),
+		optInTags:     cfg.OptInTags,
+		allTenants:    cfg.AllTenants,
+		projects:      cfg.Projects,
+		lock:          cfg.Lock,
+		shelveShutoff: cfg.ShelveShutoff,
+		adoptUntil:    cfg.AdoptLegacyUntil,
+		exclusions:    cfg.Exclusions,
+		policies:      cfg.Policies,
+		inFlight:      map[string]bool{},
+	}
+	cloud.inventory = newInventory(cloud)
+	return cloud
+}
+
+// rateLimitedTransport delays requests so that the cloud's API throttling is not tripped.
+type rateLimitedTransport struct {
+	limiter *rate.Limiter
+	next    http.RoundTripper
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
+
+func envList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func envInt(key string, def int) int {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		zap.S().Warnf("Invalid value %q for %s, using default %d", val, key, def)
+		return def
+	}
+	return n
+}
+
+func envTime(key string) time.Time {
+	val := os.Getenv(key)
+	if val == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		zap.S().Warnf("Invalid value %q for %s, expected an RFC3339 time, ignoring it", val, key)
+		return time.Time{}
+	}
+	return t
+}
+
+func envFloat(key string, def float64) float64 {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		zap.S().Warnf("Invalid value %q for %s, using default %.1f", val, key, def)
+		return def
+	}
+	return f
+}
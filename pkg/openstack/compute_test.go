@@ -0,0 +1,86 @@
+package openstack
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/platform9/pcd-vm-saver/pkg/clock"
+)
+
+// newTestCloud returns a cloud whose compute endpoint is served by handler.
+func newTestCloud(t *testing.T, handler http.Handler) *Cloud {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	cloud := newCloud(CloudConfig{Name: "test", Workers: 1})
+	cloud.compute = &gophercloud.ServiceClient{
+		ProviderClient: &gophercloud.ProviderClient{HTTPClient: *srv.Client()},
+		Endpoint:       srv.URL + "/",
+	}
+	return cloud
+}
+
+// fakeResponse is a canned compute API response.
+type fakeResponse struct {
+	code int
+	body string
+}
+
+// serverResponse is the response to GET /servers/<id>.
+func serverResponse(id, status, taskState string) fakeResponse {
+	task := "null"
+	if taskState != "" {
+		task = fmt.Sprintf("%q", taskState)
+	}
+	return fakeResponse{http.StatusOK, fmt.Sprintf(`{"server": {"id": %q, "name": "vm", "status": %q, "OS-EXT-STS:task_state": %s}}`, id, status, task)}
+}
+
+// sequence serves the responses in order, then repeats the last one.
+type sequence struct {
+	mu        sync.Mutex
+	responses []fakeResponse
+	calls     int
+}
+
+func (s *sequence) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	res := s.responses[min(s.calls, len(s.responses)-1)]
+	s.calls++
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.code)
+	fmt.Fprint(w, res.body)
+}
+
+func (s *sequence) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+// drive advances clk by step whenever the code under test waits on it, until
+// done is closed.
+func drive(clk *clock.FakeClock, done <-chan struct{}, step time.Duration) {
+	for {
+		waiting := make(chan struct{})
+		go func() {
+			clk.BlockUntil(1)
+			close(waiting)
+		}()
+		select {
+		case <-done:
+			// Release the goroutine still blocked on the clock
+			clk.After(time.Hour)
+			return
+		case <-waiting:
+			clk.Advance(step)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package openstack
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servergroups"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+)
+
+// ExclusionRule keeps the matching servers from ever being put to sleep, e.g.
+// GPU flavors or production VMs. A rule matches a server when all of its set
+// criteria match, list criteria match when any of their items does.
+type ExclusionRule struct {
+	Name string
+
+	// Flavor name glob patterns, e.g. "g1.*". Flavor names and extra specs are
+	// embedded in the server since compute microversion 2.47, before that only
+	// the flavor ID is known and matched.
+	Flavors []string
+	// Flavor extra specs, the values are glob patterns, e.g. "hw:cpu_policy": "dedicated".
+	ExtraSpecs map[string]string
+	// Image IDs
+	Images    []string
+	NameRegex *regexp.Regexp
+	// Availability zones, host aggregates are matched through the zone they expose
+	AvailabilityZones []string
+	// Server group IDs or names
+	ServerGroups []string
+
+	// Projects the rule applies to, all of them when empty.
+	Projects []string
+
+	// Expression the server must match
+	Expr *ExprRule
+}
+
+// Validate checks that the rule is well-formed.
+func (r ExclusionRule) Validate() error {
+	for _, pattern := range r.Flavors {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid flavor pattern %q: %w", pattern, err)
+		}
+	}
+	for key, pattern := range r.ExtraSpecs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q for extra spec %s: %w", pattern, key, err)
+		}
+	}
+	if len(r.Flavors) == 0 && len(r.ExtraSpecs) == 0 && len(r.Images) == 0 && r.NameRegex == nil &&
+		len(r.AvailabilityZones) == 0 && len(r.ServerGroups) == 0 && len(r.Projects) == 0 && r.Expr == nil {
+		return fmt.Errorf("no criteria set")
+	}
+	return nil
+}
+
+// match returns a description of why the rule matches the server, ok is false
+// when it does not.
+func (r ExclusionRule) match(server servers.Server, now time.Time, project string, groups []string) (matched string, ok bool) {
+	var why []string
+
+	if len(r.Projects) > 0 {
+		if !slices.Contains(r.Projects, project) {
+			return "", false
+		}
+		why = append(why, "project "+project)
+	}
+
+	if len(r.Flavors) > 0 {
+		flavor := flavorName(server)
+		if !slices.ContainsFunc(r.Flavors, func(pattern string) bool {
+			matched, _ := path.Match(pattern, flavor)
+			return matched
+		}) {
+			return "", false
+		}
+		why = append(why, "flavor "+flavor)
+	}
+
+	if len(r.ExtraSpecs) > 0 {
+		extraSpecs := flavorExtraSpecs(server)
+		for key, pattern := range r.ExtraSpecs {
+			value, exists := extraSpecs[key]
+			if !exists {
+				return "", false
+			}
+			if matched, _ := path.Match(pattern, value); !matched {
+				return "", false
+			}
+			why = append(why, fmt.Sprintf("extra spec %s=%s", key, value))
+		}
+	}
+
+	if len(r.Images) > 0 {
+		image, _ := server.Image["id"].(string)
+		if !slices.Contains(r.Images, image) {
+			return "", false
+		}
+		why = append(why, "image "+image)
+	}
+
+	if r.NameRegex != nil {
+		if !r.NameRegex.MatchString(server.Name) {
+			return "", false
+		}
+		why = append(why, fmt.Sprintf("name matching %s", r.NameRegex))
+	}
+
+	if len(r.AvailabilityZones) > 0 {
+		if !slices.Contains(r.AvailabilityZones, server.AvailabilityZone) {
+			return "", false
+		}
+		why = append(why, "availability zone "+server.AvailabilityZone)
+	}
+
+	if len(r.ServerGroups) > 0 {
+		i := slices.IndexFunc(groups, func(group string) bool { return slices.Contains(r.ServerGroups, group) })
+		if i < 0 {
+			return "", false
+		}
+		why = append(why, "server group "+groups[i])
+	}
+
+	if r.Expr != nil {
+		matched, err := r.Expr.Eval(server, now)
+		// Rather keep the server awake when the rule can't be evaluated
+		if err != nil {
+			why = append(why, "expression error: "+err.Error())
+		} else if !matched {
+			return "", false
+		} else {
+			why = append(why, "expression "+r.Expr.Source)
+		}
+	}
+
+	return strings.Join(why, ", "), true
+}
+
+// flavorName returns the flavor name embedded in the server, or the flavor ID
+// on older microversions.
+func flavorName(server servers.Server) string {
+	if name, ok := server.Flavor["original_name"].(string); ok {
+		return name
+	}
+	id, _ := server.Flavor["id"].(string)
+	return id
+}
+
+func flavorExtraSpecs(server servers.Server) map[string]string {
+	extraSpecs := map[string]string{}
+	specs, _ := server.Flavor["extra_specs"].(map[string]any)
+	for key, value := range specs {
+		extraSpecs[key] = fmt.Sprint(value)
+	}
+	return extraSpecs
+}
+
+// exclusionReason returns the reason the server is excluded from sleep by the
+// exclusion rules of the cloud, empty when it is not.
+func (c *Cloud) exclusionReason(server servers.Server, now time.Time, groups map[string][]string) string {
+	for _, rule := range c.exclusions {
+		if matched, ok := rule.match(server, now, c.projectOf(server), groups[server.ID]); ok {
+			return fmt.Sprintf("excluded by rule %q (%s)", rule.Name, matched)
+		}
+	}
+	return ""
+}
+
+// serverGroups returns the IDs and names of the server groups of each server.
+// Servers only list their groups on a GET since compute microversion 2.71, so
+// the groups are listed instead. Nothing is listed when no rule needs them.
+func (c *Cloud) serverGroups(ctx context.Context) (map[string][]string, error) {
+	if !slices.ContainsFunc(c.exclusions, func(rule ExclusionRule) bool { return len(rule.ServerGroups) > 0 }) {
+		return nil, nil
+	}
+
+	allTenants := c.allTenants || len(c.projects) > 0
+	allPages, err := servergroups.List(c.compute, servergroups.ListOpts{AllProjects: allTenants}).AllPages(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list server groups: %w", err)
+	}
+	groupList, err := servergroups.ExtractServerGroups(allPages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract server groups: %w", err)
+	}
+
+	groups := map[string][]string{}
+	for _, group := range groupList {
+		for _, member := range group.Members {
+			groups[member] = append(groups[member], group.ID, group.Name)
+		}
+	}
+	return groups, nil
+}
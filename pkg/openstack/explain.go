@@ -0,0 +1,242 @@
+package openstack
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/platform9/pcd-vm-saver/pkg/clock"
+	"github.com/platform9/pcd-vm-saver/pkg/util"
+)
+
+// How far ahead the next sleep of a server is looked for, and the precision of
+// the search. The sleep job runs every minute.
+const (
+	planHorizon = 48 * time.Hour
+	planStep    = time.Minute
+)
+
+// Verdict of one check of an explanation.
+type Verdict string
+
+const (
+	Pass  Verdict = "pass" // The check lets the server sleep/awake
+	Block Verdict = "block"
+	Info  Verdict = "info"
+)
+
+// Check is the verdict of one of the rules deciding whether a server sleeps.
+type Check struct {
+	Name    string
+	Verdict Verdict
+	Detail  string
+}
+
+// Explanation details why a server will or won't sleep or be awakened.
+type Explanation struct {
+	Cloud  string
+	Server servers.Server
+	Now    time.Time
+	Checks []Check
+
+	SleepNow  bool
+	AwakeNow  bool
+	Decision  string // Reason reported by the sleep or awake run, if any
+	NextSleep time.Time
+	NextWake  time.Time
+	Policy    string // Policy planning the next sleep
+}
+
+// FindServers returns the servers whose ID or name is ref.
+func (c *Cloud) FindServers(ctx context.Context, ref string) ([]servers.Server, error) {
+	server, err := servers.Get(ctx, c.compute, ref).Extract()
+	if err == nil {
+		return []servers.Server{*server}, nil
+	}
+	if !gophercloud.ResponseCodeIs(err, http.StatusNotFound) {
+		return nil, fmt.Errorf("failed to get server %s: %w", ref, err)
+	}
+
+	// Nova matches the name as a regular expression
+	return c.listServers(ctx, servers.ListOpts{Name: "^" + regexp.QuoteMeta(ref) + "$"})
+}
+
+// Explain runs all the checks deciding whether the server sleeps or is
+// awakened now, without acting on it, and plans its next sleep and wake.
+func (c *Cloud) Explain(ctx context.Context, clk clock.Clock, server servers.Server) (*Explanation, error) {
+	now := clk.Now()
+	e := &Explanation{Cloud: c.Name, Server: server, Now: now}
+	add := func(name string, verdict Verdict, format string, args ...any) {
+		e.Checks = append(e.Checks, Check{Name: name, Verdict: verdict, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	groups, err := c.serverGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Status and task
+	switch {
+	case server.Status == "ACTIVE", server.Status == "SHUTOFF" && c.shelveShutoff:
+		add("status", Pass, "%s servers are considered for sleep", server.Status)
+	case server.Status == "SHUTOFF":
+		add("status", Block, "SHUTOFF servers are only slept when %s is set", util.ShelveShutoffEnv)
+	case server.Status == "ERROR":
+		add("status", Block, "server is in ERROR state and needs attention")
+	default:
+		add("status", Info, "%s servers are only considered for awake", server.Status)
+	}
+	if server.TaskState != "" {
+		add("task state", Block, "task %s in progress", server.TaskState)
+	} else {
+		add("task state", Pass, "no task in progress")
+	}
+
+	// Schedule
+	sched, scheduled, schedErr := scheduleOf(server, now, c.policies)
+	switch {
+	case !scheduled:
+		add("schedule", Block, "no %s/%s metadata and no policy selects the server", util.DefaultSleepFilter, util.CustomSleepFilter)
+	case schedErr != nil:
+		add("schedule", Block, "%v", schedErr)
+	default:
+		add("schedule", Pass, "%s from %s", sched.Policy.Name(), sched.Source)
+		decision := sched.Policy.Evaluate(server, now)
+		verdict := Block
+		if decision.Sleep {
+			verdict = Pass
+		}
+		add("window", verdict, "%s", decision.Reason)
+	}
+	for _, policy := range c.policies {
+		switch matched, err := policy.matches(server, serverLabels(server), now); {
+		case err != nil:
+			add("policy "+policy.Name, Info, "%v", err)
+		case matched:
+			add("policy "+policy.Name, Info, "selects the server (%s)", policy.Policy.Name())
+		default:
+			add("policy "+policy.Name, Info, "does not select the server")
+		}
+	}
+
+	// Overrides and state
+	if server.Metadata[util.OverrideSleepFilter] == "true" {
+		add(util.OverrideSleepFilter, Block, "%s is set", util.OverrideSleepFilter)
+	} else {
+		add(util.OverrideSleepFilter, Pass, "not set")
+	}
+	state := EffectiveState(server)
+	if canTransition(state, StateSleeping) {
+		add("state", Pass, "server is %s", state)
+	} else {
+		add("state", Block, "server is %s, it can't be put to sleep", state)
+	}
+
+	// Exclusions
+	for _, rule := range c.exclusions {
+		if matched, ok := rule.match(server, now, c.projectOf(server), groups[server.ID]); ok {
+			add("exclusion "+rule.Name, Block, "matches: %s", matched)
+		} else {
+			add("exclusion "+rule.Name, Pass, "does not match")
+		}
+	}
+
+	// Manual wake and lock
+	if manualWakeCandidate(server, now) {
+		if skip := c.checkManualWake(ctx, server, now); skip.kind != 0 {
+			add("manual wake", Block, "%s", skip.reason)
+		} else {
+			add("manual wake", Pass, "no manual wake within the grace period")
+		}
+	}
+	switch {
+	case isLocked(server) && lockedByUs(server):
+		add("lock", Info, "server is locked by pcd-vm-saver")
+	case isLocked(server):
+		add("lock", Block, "server is locked by someone else")
+	}
+
+	// Awake
+	server, adopted := c.adoptLegacy(server, now)
+	if awakeTime, exists := server.Metadata[util.AwakeTimeFilter]; exists {
+		if action, owned := sleptAction(server.Metadata); adopted {
+			add("ownership", Pass, "%s by a previous release, adopted until %s", action, c.adoptUntil.Format(time.RFC3339))
+		} else if owned {
+			add("ownership", Pass, "%s by pcd-vm-saver at %s", action, server.Metadata[util.SleptAtFilter])
+		} else {
+			add("ownership", Block, "%s is set but the server was not put to sleep by pcd-vm-saver", util.AwakeTimeFilter)
+		}
+		add(util.AwakeTimeFilter, Info, "%s", awakeTime)
+		if t, err := time.Parse(time.RFC3339, awakeTime); err == nil {
+			e.NextWake = t
+		}
+	}
+
+	// Final verdicts, as computed by the sleep and awake runs
+	_, skip, ok := c.evaluateSleep(ctx, server, now, groups)
+	e.SleepNow = ok
+	if skip.kind != 0 && skip.kind != skipNotDue {
+		e.Decision = skip.reason
+	}
+	if server.Status == "ACTIVE" || slices.Contains(awakeScanStatuses, server.Status) {
+		_, skip, ok := awakeCandidate(server, now)
+		e.AwakeNow = ok && server.Status != "ACTIVE"
+		if skip.kind != 0 && skip.kind != skipNotDue {
+			e.Decision = skip.reason
+		}
+	}
+
+	// Next sleep, while the server is awake
+	if scheduled && schedErr == nil && e.NextWake.IsZero() {
+		if at, decision, ok := nextSleep(sched.Policy, server, now, planHorizon); ok {
+			e.NextSleep, e.NextWake, e.Policy = at, decision.AwakeTime, sched.Policy.Name()
+		}
+	}
+	return e, nil
+}
+
+// nextSleep returns the first time within horizon the policy puts the server
+// to sleep, and its decision then.
+func nextSleep(policy Policy, server servers.Server, from time.Time, horizon time.Duration) (time.Time, Decision, bool) {
+	for at := from; !at.After(from.Add(horizon)); at = at.Add(planStep) {
+		if decision := policy.Evaluate(server, at); decision.Sleep {
+			return at, decision, true
+		}
+	}
+	return time.Time{}, Decision{}, false
+}
+
+// String renders the explanation for the CLI.
+func (e *Explanation) String() string {
+	var b strings.Builder
+	s := e.Server
+	fmt.Fprintf(&b, "Server %s (ID: %s) in cloud %s\n", s.Name, s.ID, e.Cloud)
+	fmt.Fprintf(&b, "Status: %s, task state: %q, state: %s\n", s.Status, s.TaskState, EffectiveState(s))
+	fmt.Fprintf(&b, "Evaluated at: %s\n\n", e.Now.Format(time.RFC3339))
+
+	for _, check := range e.Checks {
+		fmt.Fprintf(&b, "  [%-5s] %s: %s\n", check.Verdict, check.Name, check.Detail)
+	}
+	b.WriteString("\n")
+
+	fmt.Fprintf(&b, "Sleeps now: %t\n", e.SleepNow)
+	fmt.Fprintf(&b, "Awakened now: %t\n", e.AwakeNow)
+	if e.Decision != "" {
+		fmt.Fprintf(&b, "Reported as: %s\n", e.Decision)
+	}
+	if !e.NextSleep.IsZero() {
+		fmt.Fprintf(&b, "Next sleep: %s (%s)\n", e.NextSleep.Format(time.RFC3339), e.Policy)
+	} else if e.NextWake.IsZero() {
+		fmt.Fprintf(&b, "Next sleep: none within %s\n", planHorizon)
+	}
+	if !e.NextWake.IsZero() {
+		fmt.Fprintf(&b, "Next wake: %s\n", e.NextWake.Format(time.RFC3339))
+	}
+	return b.String()
+}
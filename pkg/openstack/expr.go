@@ -0,0 +1,103 @@
+package openstack
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+)
+
+// ExprRule is a boolean expression evaluated against a server, its flavor and
+// the current time, e.g.
+//
+//	server.flavor.vcpus >= 16 && hoursSince(server.created) > 72
+//
+// See https://expr-lang.org for the language.
+type ExprRule struct {
+	Source  string
+	program *vm.Program
+}
+
+// exprServer is the server as seen by the expressions.
+type exprServer struct {
+	ID               string            `expr:"id"`
+	Name             string            `expr:"name"`
+	Status           string            `expr:"status"`
+	Created          time.Time         `expr:"created"`
+	Metadata         map[string]string `expr:"metadata"`
+	Tags             []string          `expr:"tags"`
+	AvailabilityZone string            `expr:"availability_zone"`
+	Project          string            `expr:"project"`
+	Image            string            `expr:"image"`
+	Flavor           exprFlavor        `expr:"flavor"`
+}
+
+// exprFlavor is the flavor embedded in the server, only the name and ID are
+// known before compute microversion 2.47.
+type exprFlavor struct {
+	Name       string            `expr:"name"`
+	VCPUs      int               `expr:"vcpus"`
+	RAM        int               `expr:"ram"`
+	Disk       int               `expr:"disk"`
+	ExtraSpecs map[string]string `expr:"extra_specs"`
+}
+
+// exprEnv returns the variables and functions available to the expressions.
+func exprEnv(server servers.Server, now time.Time) map[string]any {
+	return map[string]any{
+		"server": newExprServer(server),
+		"now":    now,
+		"hoursSince": func(t time.Time) float64 {
+			return now.Sub(t).Hours()
+		},
+	}
+}
+
+// CompileExprRule compiles a rule, checking it evaluates to a boolean.
+func CompileExprRule(source string) (*ExprRule, error) {
+	program, err := expr.Compile(source, expr.Env(exprEnv(servers.Server{}, time.Time{})), expr.AsBool())
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %w", source, err)
+	}
+	return &ExprRule{Source: source, program: program}, nil
+}
+
+// Eval evaluates the rule against the server at the given time.
+func (r *ExprRule) Eval(server servers.Server, now time.Time) (bool, error) {
+	out, err := expr.Run(r.program, exprEnv(server, now))
+	if err != nil {
+		return false, fmt.Errorf("failed to evaluate %q: %w", r.Source, err)
+	}
+	return out.(bool), nil
+}
+
+func newExprServer(server servers.Server) exprServer {
+	s := exprServer{
+		ID:               server.ID,
+		Name:             server.Name,
+		Status:           server.Status,
+		Created:          server.Created,
+		Metadata:         server.Metadata,
+		AvailabilityZone: server.AvailabilityZone,
+		Project:          server.TenantID,
+		Flavor: exprFlavor{
+			Name:       flavorName(server),
+			VCPUs:      flavorInt(server, "vcpus"),
+			RAM:        flavorInt(server, "ram"),
+			Disk:       flavorInt(server, "disk"),
+			ExtraSpecs: flavorExtraSpecs(server),
+		},
+	}
+	if server.Tags != nil {
+		s.Tags = *server.Tags
+	}
+	s.Image, _ = server.Image["id"].(string)
+	return s
+}
+
+func flavorInt(server servers.Server, key string) int {
+	value, _ := server.Flavor[key].(float64)
+	return int(value)
+}
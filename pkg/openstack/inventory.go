@@ -0,0 +1,180 @@
+package openstack
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/platform9/pcd-vm-saver/pkg/clock"
+	"go.uber.org/zap"
+)
+
+const (
+	// A snapshot younger than this is served without asking Nova, so the sleep
+	// and awake jobs firing together evaluate the same view of the servers.
+	inventoryMaxAge = 30 * time.Second
+	// Full listing interval, catches anything an incremental refresh missed.
+	// changes-since filters on the instance updated_at, which metadata and tag
+	// updates don't bump: a schedule set by a user is picked up by the next
+	// full listing. The servers are re-fetched before being acted upon.
+	inventoryFullResync = 15 * time.Minute
+	// changes-since is compared against Nova's clock, overlap the windows to
+	// tolerate clock skew. Seeing a change twice is harmless.
+	inventoryClockSkew = time.Minute
+)
+
+// Inventory is a cached view of the servers of a cloud in the statuses scanned
+// by the sleep and awake evaluations, which share it. It is listed in full
+// every inventoryFullResync and refreshed incrementally with Nova's
+// changes-since filter in between.
+type Inventory struct {
+	cloud    *Cloud
+	statuses []string
+
+	mu        sync.Mutex
+	servers   map[string]servers.Server
+	stale     map[string]bool // Acted upon since listed, re-fetched at the next refresh
+	refreshed time.Time       // Last successful refresh, full or incremental
+	fullSync  time.Time       // Last successful full listing
+}
+
+func newInventory(cloud *Cloud) *Inventory {
+	statuses := slices.Clone(sleepScanStatuses)
+	for _, status := range awakeScanStatuses {
+		if !slices.Contains(statuses, status) {
+			statuses = append(statuses, status)
+		}
+	}
+	return &Inventory{
+		cloud:    cloud,
+		statuses: statuses,
+		servers:  map[string]servers.Server{},
+		stale:    map[string]bool{},
+	}
+}
+
+// Servers returns a snapshot of the servers in any of the given statuses, or of
+// all the servers listed when none is given, refreshing the cache first if it is stale.
+func (inv *Inventory) Servers(ctx context.Context, clk clock.Clock, statuses ...string) ([]servers.Server, error) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	if err := inv.refresh(ctx, clk); err != nil {
+		return nil, err
+	}
+
+	snapshot := make([]servers.Server, 0, len(inv.servers))
+	for _, server := range inv.servers {
+		if len(statuses) == 0 || slices.Contains(statuses, server.Status) {
+			snapshot = append(snapshot, server)
+		}
+	}
+	return snapshot, nil
+}
+
+func (inv *Inventory) refresh(ctx context.Context, clk clock.Clock) error {
+	now := clk.Now()
+	if inv.refreshed.IsZero() || now.Sub(inv.refreshed) >= inventoryMaxAge {
+		if err := inv.list(ctx, now); err != nil {
+			return err
+		}
+	}
+
+	for id := range inv.stale {
+		server, err := servers.Get(ctx, inv.cloud.compute, id).Extract()
+		switch {
+		case gophercloud.ResponseCodeIs(err, http.StatusNotFound):
+			delete(inv.servers, id)
+		case err != nil:
+			return fmt.Errorf("failed to get server %s: %w", id, err)
+		default:
+			inv.put(*server)
+		}
+		delete(inv.stale, id)
+	}
+	return nil
+}
+
+func (inv *Inventory) list(ctx context.Context, now time.Time) error {
+	if inv.fullSync.IsZero() || now.Sub(inv.fullSync) >= inventoryFullResync {
+		serverList, err := inv.cloud.listServersByStatus(ctx, inv.statuses)
+		if err != nil {
+			return err
+		}
+		inv.servers = make(map[string]servers.Server, len(serverList))
+		for _, server := range serverList {
+			inv.servers[server.ID] = server
+		}
+		clear(inv.stale)
+		inv.refreshed, inv.fullSync = now, now
+		zap.S().Infof("Inventory of cloud %s fully refreshed: %d servers", inv.cloud.Name, len(inv.servers))
+		return nil
+	}
+
+	// Not filtered on status, so that the servers which left the listed
+	// statuses, e.g. deleted or resizing, are seen and dropped
+	since := inv.refreshed.Add(-inventoryClockSkew).UTC().Format(time.RFC3339)
+	changed, err := inv.cloud.listServers(ctx, servers.ListOpts{ChangesSince: since})
+	if err != nil {
+		return err
+	}
+	for _, server := range changed {
+		inv.put(server)
+	}
+	inv.refreshed = now
+	zap.S().Debugf("Inventory of cloud %s refreshed: %d servers changed since %s", inv.cloud.Name, len(changed), since)
+	return nil
+}
+
+// put stores the server, or drops it when it is not in a listed status anymore.
+func (inv *Inventory) put(server servers.Server) {
+	if !slices.Contains(inv.statuses, server.Status) {
+		delete(inv.servers, server.ID)
+		return
+	}
+	inv.servers[server.ID] = server
+}
+
+// invalidate marks the server as changed by us, it is re-fetched at the next refresh.
+func (inv *Inventory) invalidate(id string) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.stale[id] = true
+}
+
+// recheck fetches a server evaluated from the inventory before it is acted
+// upon, as its metadata may be up to inventoryFullResync old. When the server
+// changed since it was evaluated skip holds why it must be left alone.
+func (c *Cloud) recheck(ctx context.Context, clk clock.Clock, id, status string, metadata map[string]string) (skip string, err error) {
+	var server *servers.Server
+	_, err = retry(ctx, clk, DefaultRetryPolicy, "get server "+id, func() (getErr error) {
+		server, getErr = servers.Get(ctx, c.compute, id).Extract()
+		return getErr
+	})
+	if gophercloud.ResponseCodeIs(err, http.StatusNotFound) {
+		return "server was deleted", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get server %s: %w", id, err)
+	}
+
+	c.inventory.mu.Lock()
+	c.inventory.put(*server)
+	c.inventory.mu.Unlock()
+
+	switch {
+	case server.Status != status:
+		return fmt.Sprintf("server is now %s", server.Status), nil
+	case server.TaskState != "":
+		return fmt.Sprintf("task %s in progress", server.TaskState), nil
+	case !maps.Equal(server.Metadata, metadata):
+		return "server metadata changed since it was evaluated", nil
+	}
+	return "", nil
+}
@@ -0,0 +1,259 @@
+package openstack
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/platform9/pcd-vm-saver/pkg/clock"
+)
+
+type fakeServer struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Status    string            `json:"status"`
+	TaskState *string           `json:"OS-EXT-STS:task_state"`
+	Metadata  map[string]string `json:"metadata"`
+	Updated   time.Time         `json:"updated"`
+}
+
+// fakeNova serves the server listings and GETs from its servers, filtered on
+// status and changes-since as Nova does, and records the requests.
+type fakeNova struct {
+	clk *clock.FakeClock
+
+	mu       sync.Mutex
+	servers  map[string]*fakeServer
+	requests []string
+}
+
+func newFakeNova(clk *clock.FakeClock, serverList ...fakeServer) *fakeNova {
+	nova := &fakeNova{clk: clk, servers: map[string]*fakeServer{}}
+	for _, server := range serverList {
+		server.Updated = clk.Now()
+		nova.servers[server.ID] = &server
+	}
+	return nova
+}
+
+// update changes a server as an action would, which bumps its updated time.
+func (n *fakeNova) update(id, status string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.servers[id].Status = status
+	n.servers[id].Updated = n.clk.Now()
+}
+
+// setMetadata changes the metadata of a server, which does not bump its updated time.
+func (n *fakeNova) setMetadata(id string, metadata map[string]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.servers[id].Metadata = metadata
+}
+
+func (n *fakeNova) takeRequests() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	requests := n.requests
+	n.requests = nil
+	return requests
+}
+
+func (n *fakeNova) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.requests = append(n.requests, r.Method+" "+r.URL.RequestURI())
+	w.Header().Set("Content-Type", "application/json")
+
+	if id, found := strings.CutPrefix(r.URL.Path, "/servers/"); found && id != "detail" {
+		server, exists := n.servers[id]
+		if !exists || server.Status == "DELETED" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"itemNotFound": {"code": 404}}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"server": server})
+		return
+	}
+
+	query := r.URL.Query()
+	var since time.Time
+	if query.Has("changes-since") {
+		since, _ = time.Parse(time.RFC3339, query.Get("changes-since"))
+	}
+	list := []*fakeServer{}
+	for _, id := range slices.Sorted(maps.Keys(n.servers)) {
+		server := n.servers[id]
+		switch {
+		case query.Has("status") && server.Status != query.Get("status"):
+		case !since.IsZero() && server.Updated.Before(since):
+		// Deleted servers are only listed as changed
+		case since.IsZero() && server.Status == "DELETED":
+		default:
+			list = append(list, server)
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]any{"servers": list})
+}
+
+func TestInventoryRefresh(t *testing.T) {
+	start := time.Date(2026, 10, 19, 20, 1, 0, 0, time.UTC)
+	clk := clock.NewFake(start)
+	nova := newFakeNova(clk,
+		fakeServer{ID: "active", Status: "ACTIVE"},
+		fakeServer{ID: "shelved", Status: "SHELVED_OFFLOADED"},
+		fakeServer{ID: "shutoff", Status: "SHUTOFF"},
+		fakeServer{ID: "building", Status: "BUILD"},
+	)
+	cloud := newTestCloud(t, nova)
+	inv := cloud.inventory
+	ctx := context.Background()
+
+	servers := func(statuses ...string) []string {
+		t.Helper()
+		serverList, err := inv.Servers(ctx, clk, statuses...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var list []string
+		for _, server := range serverList {
+			list = append(list, server.ID)
+		}
+		slices.Sort(list)
+		return list
+	}
+
+	// The first listing is a full one, filtered on the scanned statuses
+	if got, want := servers(), []string{"active", "shelved", "shutoff"}; !slices.Equal(got, want) {
+		t.Errorf("servers %v, want %v", got, want)
+	}
+	requests := nova.takeRequests()
+	if len(requests) != len(inv.statuses) {
+		t.Errorf("%d requests for %d statuses: %v", len(requests), len(inv.statuses), requests)
+	}
+	for _, request := range requests {
+		if !strings.Contains(request, "status=") {
+			t.Errorf("full listing request %s not filtered on status", request)
+		}
+	}
+	if got, want := servers("ACTIVE"), []string{"active"}; !slices.Equal(got, want) {
+		t.Errorf("ACTIVE servers %v, want %v", got, want)
+	}
+	if got, want := servers(awakeScanStatuses...), []string{"shelved", "shutoff"}; !slices.Equal(got, want) {
+		t.Errorf("awake scan servers %v, want %v", got, want)
+	}
+
+	// A fresh snapshot is served without asking Nova
+	clk.Advance(10 * time.Second)
+	servers()
+	if requests := nova.takeRequests(); len(requests) != 0 {
+		t.Errorf("requests %v, want none", requests)
+	}
+
+	// Then only the changes are listed, the servers leaving the scanned
+	// statuses are dropped
+	clk.Advance(time.Minute)
+	nova.update("active", "RESIZE")
+	nova.update("shelved", "DELETED")
+	nova.update("building", "ACTIVE")
+	if got, want := servers(), []string{"building", "shutoff"}; !slices.Equal(got, want) {
+		t.Errorf("servers %v, want %v", got, want)
+	}
+	requests = nova.takeRequests()
+	if len(requests) != 1 || !strings.Contains(requests[0], "changes-since=") || strings.Contains(requests[0], "status=") {
+		t.Errorf("requests %v, want a single unfiltered changes-since listing", requests)
+	}
+
+	// Nova does not bump updated_at on metadata changes, the incremental
+	// refreshes don't see them
+	nova.setMetadata("shutoff", map[string]string{"sleep_zone": "ist"})
+	clk.Advance(2 * time.Minute)
+	serverList, _ := inv.Servers(ctx, clk, "SHUTOFF")
+	if len(serverList) != 1 || len(serverList[0].Metadata) != 0 {
+		t.Errorf("SHUTOFF servers %v, want the metadata change not seen yet", serverList)
+	}
+	nova.takeRequests()
+
+	// The metadata changes are caught up by the next full listing
+	clk.Set(start.Add(inventoryFullResync))
+	serverList, _ = inv.Servers(ctx, clk, "SHUTOFF")
+	if len(serverList) != 1 || serverList[0].Metadata["sleep_zone"] != "ist" {
+		t.Errorf("SHUTOFF servers %v, want the metadata updated by the full listing", serverList)
+	}
+	if requests := nova.takeRequests(); len(requests) != len(inv.statuses) {
+		t.Errorf("requests %v, want a full listing", requests)
+	}
+}
+
+func TestInventoryInvalidate(t *testing.T) {
+	clk := clock.NewFake(time.Date(2026, 10, 19, 20, 1, 0, 0, time.UTC))
+	nova := newFakeNova(clk,
+		fakeServer{ID: "slept", Status: "ACTIVE"},
+		fakeServer{ID: "deleted", Status: "ACTIVE"},
+	)
+	cloud := newTestCloud(t, nova)
+	ctx := context.Background()
+	if _, err := cloud.inventory.Servers(ctx, clk); err != nil {
+		t.Fatal(err)
+	}
+	nova.takeRequests()
+
+	// The servers acted upon are re-fetched even within inventoryMaxAge
+	nova.update("slept", "SHELVED_OFFLOADED")
+	nova.update("deleted", "DELETED")
+	cloud.inventory.invalidate("slept")
+	cloud.inventory.invalidate("deleted")
+	serverList, err := cloud.inventory.Servers(ctx, clk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serverList) != 1 || serverList[0].ID != "slept" || serverList[0].Status != "SHELVED_OFFLOADED" {
+		t.Errorf("servers %v, want slept SHELVED_OFFLOADED", serverList)
+	}
+	requests := nova.takeRequests()
+	slices.Sort(requests)
+	if want := []string{"GET /servers/deleted", "GET /servers/slept"}; !slices.Equal(requests, want) {
+		t.Errorf("requests %v, want %v", requests, want)
+	}
+
+	// Once re-fetched they are served from the cache again
+	cloud.inventory.Servers(ctx, clk)
+	if requests := nova.takeRequests(); len(requests) != 0 {
+		t.Errorf("requests %v, want none", requests)
+	}
+}
+
+func TestRecheck(t *testing.T) {
+	metadata := map[string]string{"sleep_zone": "ist"}
+	shelving := "shelving"
+	tests := []struct {
+		name   string
+		server fakeServer
+		skip   string
+	}{
+		{"unchanged", fakeServer{ID: "id", Status: "ACTIVE", Metadata: metadata}, ""},
+		{"status changed", fakeServer{ID: "id", Status: "SHELVED_OFFLOADED", Metadata: metadata}, "server is now SHELVED_OFFLOADED"},
+		{"task in progress", fakeServer{ID: "id", Status: "ACTIVE", TaskState: &shelving, Metadata: metadata}, "task shelving in progress"},
+		{"metadata changed", fakeServer{ID: "id", Status: "ACTIVE", Metadata: map[string]string{"sleep_zone": "ist", "save_sleep": "true"}}, "server metadata changed since it was evaluated"},
+		{"deleted", fakeServer{ID: "other"}, "server was deleted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clk := clock.NewFake(time.Date(2026, 10, 19, 20, 1, 0, 0, time.UTC))
+			cloud := newTestCloud(t, newFakeNova(clk, tt.server))
+			skip, err := cloud.recheck(context.Background(), clk, "id", "ACTIVE", metadata)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if skip != tt.skip {
+				t.Errorf("skip = %q, want %q", skip, tt.skip)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package openstack
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/platform9/pcd-vm-saver/pkg/util"
+	"go.uber.org/zap"
+)
+
+// legacySleep returns the sleep action of a server put to sleep by a release
+// predating the ownership marker, which only recorded the awake time. Such a
+// server has an awake time, no vmsaver_* key, and the status left by the action
+// its ram_preserve setting selected. The state keys written by an interrupted
+// wake of the adopted server are ignored, so that it is retried.
+func legacySleep(server servers.Server) (action string, ok bool) {
+	if _, exists := server.Metadata[util.AwakeTimeFilter]; !exists {
+		return "", false
+	}
+	for key := range server.Metadata {
+		if strings.HasPrefix(key, "vmsaver_") && key != util.StateFilter && key != util.StateSinceFilter {
+			return "", false
+		}
+	}
+	action = "shelve"
+	if server.Metadata[util.SleepModeFilter] == "true" {
+		action = "suspend"
+	}
+	return action, slices.Contains(sleptStatuses[action], server.Status)
+}
+
+// adoptLegacy returns the server with the ownership marker of its legacy sleep
+// until the adoption deadline of the cloud, so that it is awakened as if
+// pcd-vm-saver had recorded it. The sleep is recorded as of now, its actual
+// time is unknown. Nothing is written to the server, the marker keys are
+// removed with the awake time once it is awake.
+func (c *Cloud) adoptLegacy(server servers.Server, now time.Time) (servers.Server, bool) {
+	if c.adoptUntil.IsZero() || !now.Before(c.adoptUntil) {
+		return server, false
+	}
+	action, ok := legacySleep(server)
+	if !ok {
+		return server, false
+	}
+	server.Metadata = copyMetadata(server.Metadata)
+	server.Metadata[util.SleptAtFilter] = now.Format(time.RFC3339)
+	server.Metadata[util.SleptActionFilter] = action
+	if _, exists := server.Metadata[util.StateFilter]; !exists {
+		server.Metadata[util.StateFilter] = string(StateAsleep)
+	}
+	return server, true
+}
+
+// warnStranded logs the servers put to sleep by a previous release which are
+// not adopted, they stay asleep until they are.
+func (c *Cloud) warnStranded(stranded int) {
+	if stranded == 0 {
+		return
+	}
+	zap.S().Warnf("Cloud %s: %d VM(s) put to sleep by a previous release stay asleep, set %s (adopt_legacy_until) to awaken them",
+		c.Name, stranded, util.AdoptLegacyUntilEnv)
+}
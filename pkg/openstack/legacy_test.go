@@ -0,0 +1,104 @@
+package openstack
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/platform9/pcd-vm-saver/pkg/clock"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestAdoptLegacy(t *testing.T) {
+	until := time.Date(2026, 10, 22, 0, 0, 0, 0, time.UTC)
+	before := time.Date(2026, 10, 20, 9, 0, 0, 0, time.UTC)
+	awakeTime := "2026-10-20T08:30:00Z"
+
+	tests := []struct {
+		name     string
+		status   string
+		metadata map[string]string
+		now      time.Time
+		action   string // empty when not adopted
+	}{
+		{"shelved", "SHELVED_OFFLOADED", map[string]string{"awake_time": awakeTime}, before, "shelve"},
+		{"shelved, not offloaded", "SHELVED", map[string]string{"awake_time": awakeTime}, before, "shelve"},
+		{"suspended", "SUSPENDED", map[string]string{"awake_time": awakeTime, "ram_preserve": "true"}, before, "suspend"},
+		{"interrupted wake", "SHELVED_OFFLOADED", map[string]string{"awake_time": awakeTime, "vmsaver_state": "waking", "vmsaver_state_since": awakeTime}, before, "shelve"},
+		{"status not matching ram_preserve", "SHELVED_OFFLOADED", map[string]string{"awake_time": awakeTime, "ram_preserve": "true"}, before, ""},
+		{"suspended without ram_preserve", "SUSPENDED", map[string]string{"awake_time": awakeTime}, before, ""},
+		{"active", "ACTIVE", map[string]string{"awake_time": awakeTime}, before, ""},
+		{"no awake time", "SHELVED_OFFLOADED", map[string]string{"sleep_zone": "ist"}, before, ""},
+		{"owned", "SHELVED_OFFLOADED", map[string]string{"awake_time": awakeTime, "vmsaver_slept_at": awakeTime, "vmsaver_action": "shelve"}, before, ""},
+		{"after the deadline", "SHELVED_OFFLOADED", map[string]string{"awake_time": awakeTime}, until, ""},
+	}
+
+	cloud := NewOfflineCloud(CloudConfig{Name: "test", AdoptLegacyUntil: until})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := servers.Server{ID: "id", Name: "vm", Status: tt.status, Metadata: tt.metadata}
+			adopted, ok := cloud.adoptLegacy(server, tt.now)
+			if ok != (tt.action != "") {
+				t.Fatalf("adopted = %t, want %t", ok, tt.action != "")
+			}
+			if !ok {
+				if len(adopted.Metadata) != len(tt.metadata) {
+					t.Errorf("Metadata = %v, want it unchanged", adopted.Metadata)
+				}
+				return
+			}
+			if action, owned := sleptAction(adopted.Metadata); !owned || action != tt.action {
+				t.Errorf("sleptAction = %q, %t, want %q, true", action, owned, tt.action)
+			}
+			if sleptAt := adopted.Metadata["vmsaver_slept_at"]; sleptAt != tt.now.Format(time.RFC3339) {
+				t.Errorf("vmsaver_slept_at = %q, want the adoption time", sleptAt)
+			}
+			if _, changed := tt.metadata["vmsaver_action"]; changed {
+				t.Error("the metadata of the server was modified")
+			}
+			if _, _, ok := awakeCandidate(adopted, tt.now); !ok {
+				t.Error("adopted server not awakened after its awake time")
+			}
+		})
+	}
+}
+
+func TestAdoptLegacyDisabled(t *testing.T) {
+	cloud := NewOfflineCloud(CloudConfig{Name: "test"})
+	server := servers.Server{Status: "SHELVED_OFFLOADED", Metadata: map[string]string{"awake_time": "2026-10-20T08:30:00Z"}}
+	if _, ok := cloud.adoptLegacy(server, time.Date(2026, 10, 20, 9, 0, 0, 0, time.UTC)); ok {
+		t.Error("server adopted without a deadline")
+	}
+}
+
+func TestGetVMsToAwakeStranded(t *testing.T) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	defer zap.ReplaceGlobals(zap.New(core))()
+
+	clk := clock.NewFake(time.Date(2026, 10, 20, 9, 0, 0, 0, time.UTC))
+	legacy := map[string]string{"awake_time": "2026-10-20T08:30:00Z"}
+	cloud := newTestCloud(t, newFakeNova(clk,
+		fakeServer{ID: "due", Status: "SHELVED_OFFLOADED", Metadata: legacy},
+		fakeServer{ID: "later", Status: "SUSPENDED", Metadata: map[string]string{"awake_time": "2026-10-21T08:30:00Z", "ram_preserve": "true"}},
+	))
+
+	awakeVMs, skipped, err := cloud.GetVMsToAwake(context.Background(), clk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(awakeVMs) != 0 {
+		t.Errorf("%d VMs to awake without adoption, want none", len(awakeVMs))
+	}
+	if len(skipped) != 1 || skipped[0].ID != "due" || !strings.Contains(skipped[0].Reason, "previous release") {
+		t.Errorf("skipped %v, want the VM due reported as put to sleep by a previous release", skipped)
+	}
+	// Every run warns about all of them
+	warnings := logs.FilterMessageSnippet("VMSAVER_ADOPT_LEGACY_UNTIL").All()
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Message, " 2 VM(s)") {
+		t.Errorf("warnings %v, want one counting 2 VMs", warnings)
+	}
+}
@@ -0,0 +1,78 @@
+package openstack
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+)
+
+// Statuses the sleep scan considers: the ACTIVE servers, the SHUTOFF ones when
+// they are shelved too, and the ERROR ones reported as needing attention.
+var sleepScanStatuses = []string{"ACTIVE", "SHUTOFF", "ERROR"}
+
+// Statuses a slept VM can be found in, the awake scan only considers these.
+var awakeScanStatuses = []string{"SHELVED_OFFLOADED", "SHELVED", "SUSPENDED", "PAUSED", "SHUTOFF"}
+
+// listServers lists the servers matching opts. When opt-in tags are configured
+// only the servers carrying at least one of them are fetched. In admin mode the
+// servers of all the projects, or of the configured projects, are listed.
+func (c *Cloud) listServers(ctx context.Context, opts servers.ListOpts) ([]servers.Server, error) {
+	if len(c.optInTags) > 0 {
+		opts.TagsAny = strings.Join(c.optInTags, ",")
+	}
+
+	if len(c.projects) == 0 {
+		opts.AllTenants = c.allTenants
+		return c.listPages(ctx, opts)
+	}
+
+	var serverList []servers.Server
+	for _, project := range c.projects {
+		opts.AllTenants = true
+		opts.TenantID = project
+		list, err := c.listPages(ctx, opts)
+		if err != nil {
+			return nil, fmt.Errorf("project %s: %w", project, err)
+		}
+		serverList = append(serverList, list...)
+	}
+	return serverList, nil
+}
+
+// listServersByStatus lists the servers in any of the given statuses. Nova
+// filters on a single status per request, so one request is made per status.
+func (c *Cloud) listServersByStatus(ctx context.Context, statuses []string) ([]servers.Server, error) {
+	var serverList []servers.Server
+	for _, status := range statuses {
+		list, err := c.listServers(ctx, servers.ListOpts{Status: status})
+		if err != nil {
+			return nil, fmt.Errorf("status %s: %w", status, err)
+		}
+		serverList = append(serverList, list...)
+	}
+	return serverList, nil
+}
+
+func (c *Cloud) listPages(ctx context.Context, opts servers.ListOpts) ([]servers.Server, error) {
+	allPages, err := servers.List(c.compute, opts).AllPages(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list servers: %w", err)
+	}
+
+	// Extract server list
+	serverList, err := servers.ExtractServers(allPages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract servers: %w", err)
+	}
+	return serverList, nil
+}
+
+// projectOf returns the project owning the server.
+func (c *Cloud) projectOf(server servers.Server) string {
+	if server.TenantID != "" {
+		return server.TenantID
+	}
+	return c.ProjectID
+}
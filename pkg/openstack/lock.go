@@ -0,0 +1,71 @@
+package openstack
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/platform9/pcd-vm-saver/pkg/clock"
+	"github.com/platform9/pcd-vm-saver/pkg/result"
+	"github.com/platform9/pcd-vm-saver/pkg/util"
+	"go.uber.org/zap"
+)
+
+// isLocked reports whether the server is locked in Nova, as far as the
+// microversion lets us know.
+func isLocked(server servers.Server) bool {
+	return server.Locked != nil && *server.Locked
+}
+
+// lockedByUs reports whether the lock of the server was taken by pcd-vm-saver
+// when putting it to sleep.
+func lockedByUs(server servers.Server) bool {
+	return server.Metadata[util.LockedFilter] == "true"
+}
+
+// needsUnlock reports whether the lock taken by pcd-vm-saver must be released
+// before awakening the server. Without the locked field, i.e. before compute
+// microversion 2.9, the server is unlocked whenever we may have locked it.
+func needsUnlock(server servers.Server) bool {
+	return lockedByUs(server) && (server.Locked == nil || *server.Locked)
+}
+
+// lockVM locks an asleep server, with a reason shown to the other users when
+// the microversion supports it.
+func (c *Cloud) lockVM(ctx context.Context, clk clock.Clock, server serverSleepInfo, res *result.VMResult) error {
+	attempts, err := retry(ctx, clk, DefaultRetryPolicy, "lock "+server.Name, func() error {
+		if !c.Features.LockedReason {
+			return servers.Lock(ctx, c.compute, server.ID).ExtractErr()
+		}
+		body := map[string]any{"lock": map[string]string{
+			"locked_reason": "asleep by pcd-vm-saver until " + server.AwakeTime.Format(time.RFC3339),
+		}}
+		_, err := c.compute.Post(ctx, c.compute.ServiceURL("servers", server.ID, "action"), body, nil, &gophercloud.RequestOpts{
+			OkCodes: []int{http.StatusAccepted},
+		})
+		return err
+	})
+	res.Attempts += attempts
+	if err != nil {
+		zap.S().Errorf("Failed to lock server %s: %v", server.Name, err)
+		return err
+	}
+	zap.S().Infof("Locked server %s with ID %s while asleep", server.Name, server.ID)
+	return nil
+}
+
+// unlockVM releases the lock taken by lockVM before the server is awakened.
+func (c *Cloud) unlockVM(ctx context.Context, clk clock.Clock, server serverAwakeInfo, res *result.VMResult) error {
+	attempts, err := retry(ctx, clk, DefaultRetryPolicy, "unlock "+server.Name, func() error {
+		return servers.Unlock(ctx, c.compute, server.ID).ExtractErr()
+	})
+	res.Attempts += attempts
+	if err != nil {
+		zap.S().Errorf("Failed to unlock server %s: %v", server.Name, err)
+		return err
+	}
+	zap.S().Infof("Unlocked server %s with ID %s", server.Name, server.ID)
+	return nil
+}
@@ -0,0 +1,123 @@
+package openstack
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/instanceactions"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/platform9/pcd-vm-saver/pkg/util"
+)
+
+// Values of the ManualWakeGraceFilter metadata key, any other value is a
+// number of hours.
+const (
+	graceWindow = "window" // Leave the VM awake until the current window ends (default)
+	graceNone   = "none"   // Put the VM back to sleep on the next tick
+)
+
+// Nova instance actions that wake a server up.
+var wakeActions = []string{"unshelve", "resume", "start", "unpause"}
+
+// manualWakeCandidate reports whether the server may have been woken up by a
+// user: it is ACTIVE with no task in progress while pcd-vm-saver put it to
+// sleep and its awake time is still ahead.
+func manualWakeCandidate(server servers.Server, now time.Time) bool {
+	if server.Status != "ACTIVE" || server.TaskState != "" {
+		return false
+	}
+	if _, owned := sleptAction(server.Metadata); !owned {
+		return false
+	}
+	if state := StoredState(server.Metadata); state != StateSleeping && state != StateAsleep {
+		return false
+	}
+	awakeTime, err := time.Parse(time.RFC3339, server.Metadata[util.AwakeTimeFilter])
+	return err == nil && now.Before(awakeTime)
+}
+
+// manualWake returns the instance action which woke the server up after
+// pcd-vm-saver put it to sleep. ok is false when the server was never slept,
+// e.g. the sleep action was interrupted by a restart.
+func (c *Cloud) manualWake(ctx context.Context, server servers.Server) (wake instanceactions.InstanceAction, ok bool, err error) {
+	sleptAt, err := time.Parse(time.RFC3339, server.Metadata[util.SleptAtFilter])
+	if err != nil {
+		return wake, false, fmt.Errorf("invalid %s value: %w", util.SleptAtFilter, err)
+	}
+
+	allPages, err := instanceactions.List(c.compute, server.ID, nil).AllPages(ctx)
+	if err != nil {
+		return wake, false, fmt.Errorf("failed to list instance actions of server %s: %w", server.ID, err)
+	}
+	actions, err := instanceactions.ExtractInstanceActions(allPages)
+	if err != nil {
+		return wake, false, fmt.Errorf("failed to extract instance actions of server %s: %w", server.ID, err)
+	}
+
+	// Actions are listed newest first, the timestamps have a second precision
+	for _, action := range actions {
+		if action.StartTime.Before(sleptAt.Add(-time.Second)) {
+			break
+		}
+		if slices.Contains(wakeActions, action.Action) && !ok {
+			wake, ok = action, true
+		}
+	}
+	return wake, ok, nil
+}
+
+// manualWakeGrace returns until when a server woken up by a user at wokeAt is
+// left awake, according to its ManualWakeGraceFilter.
+func manualWakeGrace(server servers.Server, wokeAt time.Time) (time.Time, error) {
+	// The awake time is the end of the window the server was slept for
+	windowEnd, err := time.Parse(time.RFC3339, server.Metadata[util.AwakeTimeFilter])
+	if err != nil {
+		return windowEnd, fmt.Errorf("invalid %s value: %w", util.AwakeTimeFilter, err)
+	}
+
+	grace, exists := server.Metadata[util.ManualWakeGraceFilter]
+	switch {
+	case !exists || grace == graceWindow:
+		return windowEnd, nil
+	case grace == graceNone:
+		return wokeAt, nil
+	}
+
+	hours, err := strconv.ParseFloat(grace, 64)
+	if err != nil || hours < 0 {
+		return windowEnd, fmt.Errorf("invalid %s value %q, using %s", util.ManualWakeGraceFilter, grace, graceWindow)
+	}
+	return wokeAt.Add(time.Duration(hours * float64(time.Hour))), nil
+}
+
+// checkManualWake returns the skip of a server woken up by a user that is
+// still within its grace period, the zero skip when it can be put to sleep.
+func (c *Cloud) checkManualWake(ctx context.Context, server servers.Server, now time.Time) skip {
+	if !manualWakeCandidate(server, now) {
+		return skip{}
+	}
+
+	wake, ok, err := c.manualWake(ctx, server)
+	if err != nil {
+		// Rather leave the server awake than fight the user
+		return skip{skipFailed, "could not check for a manual wake: " + err.Error()}
+	}
+	if !ok {
+		return skip{}
+	}
+
+	// An invalid grace falls back to the window, which is still ahead
+	graceUntil, graceErr := manualWakeGrace(server, wake.StartTime)
+	if !now.Before(graceUntil) {
+		return skip{}
+	}
+	reason := fmt.Sprintf("woken up manually by %s of user %s at %s, left awake until %s",
+		wake.Action, wake.UserID, wake.StartTime.Format(time.RFC3339), graceUntil.Format(time.RFC3339))
+	if graceErr != nil {
+		reason += " (" + graceErr.Error() + ")"
+	}
+	return skip{skipLeftAlone, reason}
+}
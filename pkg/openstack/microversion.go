@@ -0,0 +1,71 @@
+package openstack
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/utils"
+	"go.uber.org/zap"
+)
+
+// Highest compute microversion pcd-vm-saver has been validated against, the
+// negotiated version never exceeds it.
+const maxMicroversion = "2.96"
+
+// Compute microversions introducing the features pcd-vm-saver relies on.
+const (
+	tagsMicroversion           = "2.26" // Server tags and tags-any filter
+	embeddedFlavorMicroversion = "2.47" // Flavor name and extra specs embedded in the server
+	lockedReasonMicroversion   = "2.73" // locked_reason on lock
+	unshelveAZMicroversion     = "2.77" // Unshelve to an availability zone
+)
+
+// Features lists the compute features available with the negotiated microversion.
+type Features struct {
+	Microversion   string
+	Tags           bool
+	EmbeddedFlavor bool
+	LockedReason   bool
+	UnshelveAZ     bool
+}
+
+// negotiateMicroversion sets the client microversion to the highest version
+// supported by both the cloud and pcd-vm-saver and returns the features it
+// enables. Clouds without microversion support keep the base version.
+func negotiateMicroversion(ctx context.Context, client *gophercloud.ServiceClient) (Features, error) {
+	var features Features
+
+	supported, err := utils.GetSupportedMicroversions(ctx, client)
+	if err != nil {
+		return features, fmt.Errorf("failed to get supported compute microversions: %w", err)
+	}
+
+	maxMajor, maxMinor, _ := utils.ParseMicroversion(maxMicroversion)
+	major, minor := supported.MaxMajor, supported.MaxMinor
+	if major > maxMajor || (major == maxMajor && minor > maxMinor) {
+		major, minor = maxMajor, maxMinor
+	}
+	version := fmt.Sprintf("%d.%d", major, minor)
+	client.Microversion = version
+
+	features = Features{
+		Microversion:   version,
+		Tags:           microversionAtLeast(version, tagsMicroversion),
+		EmbeddedFlavor: microversionAtLeast(version, embeddedFlavorMicroversion),
+		LockedReason:   microversionAtLeast(version, lockedReasonMicroversion),
+		UnshelveAZ:     microversionAtLeast(version, unshelveAZMicroversion),
+	}
+	zap.S().Infof("Negotiated compute microversion %s (cloud supports %d.%d-%d.%d), features: %+v",
+		version, supported.MinMajor, supported.MinMinor, supported.MaxMajor, supported.MaxMinor, features)
+	return features, nil
+}
+
+func microversionAtLeast(version, required string) bool {
+	major, minor, err := utils.ParseMicroversion(version)
+	if err != nil {
+		return false
+	}
+	reqMajor, reqMinor, _ := utils.ParseMicroversion(required)
+	return major > reqMajor || (major == reqMajor && minor >= reqMinor)
+}
@@ -0,0 +1,208 @@
+package openstack
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/platform9/pcd-vm-saver/pkg/clock"
+	"github.com/platform9/pcd-vm-saver/pkg/util"
+)
+
+// Event is a sleep or wake of a server planned by the schedules.
+type Event struct {
+	Cloud   string    `json:"cloud"`
+	Project string    `json:"project"`
+	Server  string    `json:"server"`
+	ID      string    `json:"id"`
+	Action  string    `json:"action"` // shelve, suspend, unshelve or resume
+	At      time.Time `json:"at"`
+	Until   time.Time `json:"until,omitzero"` // Awake time of a sleep
+	Now     bool      `json:"now"`            // The action is due at the current run
+	Policy  string    `json:"policy,omitempty"`
+}
+
+// Plan returns the sleeps and wakes planned by the schedules from now until
+// the horizon, ordered by time. Nothing is changed on the servers: the actions
+// due now are evaluated as the sleep and awake runs would, the later ones
+// assume every planned action succeeds and nobody else acts on the servers.
+func (c *Cloud) Plan(ctx context.Context, clk clock.Clock, horizon time.Duration) ([]Event, error) {
+	serverList, err := c.inventory.Servers(ctx, clk)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := c.serverGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := clk.Now()
+	var events []Event
+	for _, server := range serverList {
+		server, _ = c.adoptLegacy(server, now)
+		events = append(events, c.simulate(ctx, server, now, now.Add(horizon), groups, true)...)
+	}
+	sortEvents(events)
+	return events, nil
+}
+
+// simulate replays the sleep and awake decisions for the server between from
+// and to. When live, the decisions at from are those of the sleep and awake
+// runs, which may query Nova, e.g. for the manual wakes.
+func (c *Cloud) simulate(ctx context.Context, server servers.Server, from, to time.Time, groups map[string][]string, live bool) []Event {
+	// Nothing can happen to a server without schedule nor awake time
+	if len(c.policies) == 0 && !hasSchedule(server, from, nil) {
+		return nil
+	}
+
+	var events []Event
+	for at := from; !at.After(to); {
+		if awakeTime, asleep := plannedWake(server); asleep {
+			wakeAt := awakeTime.Add(planStep)
+			if wakeAt.Before(at) {
+				wakeAt = at
+			}
+			if wakeAt.After(to) {
+				break
+			}
+			info, _, ok := awakeCandidate(server, wakeAt)
+			if !ok {
+				break
+			}
+			if !info.AlreadyActive {
+				action := "unshelve"
+				if info.SuspendMode {
+					action = "resume"
+				}
+				events = append(events, c.newEvent(server, action, wakeAt, from))
+			}
+			server = wokenServer(server, info, wakeAt)
+			at = wakeAt.Add(planStep)
+			continue
+		}
+
+		// Nothing else happens to a server the sleep run ignores, the status
+		// and overrides are only changed by users
+		if !c.sleepable(server) || server.Metadata[util.OverrideSleepFilter] == "true" {
+			break
+		}
+		sleepAt, info, ok := c.nextPlannedSleep(ctx, server, at, to, groups, live && at.Equal(from))
+		if !ok {
+			break
+		}
+		event := c.newEvent(server, "shelve", sleepAt, from)
+		if info.SuspendMode {
+			event.Action = "suspend"
+		}
+		event.Until, event.Policy = info.AwakeTime, info.Policy
+		events = append(events, event)
+		server = sleptServer(server, info)
+		at = sleepAt.Add(planStep)
+	}
+	return events
+}
+
+// nextPlannedSleep returns the first time between from and to the server is
+// put to sleep. When live, the first time is evaluated as the sleep run would.
+func (c *Cloud) nextPlannedSleep(ctx context.Context, server servers.Server, from, to time.Time, groups map[string][]string, live bool) (time.Time, serverSleepInfo, bool) {
+	at := from
+	if live {
+		if info, _, ok := c.evaluateSleep(ctx, server, from, groups); ok {
+			return from, info, true
+		}
+		at = at.Add(planStep)
+	}
+	for ; !at.After(to); at = at.Add(planStep) {
+		if info, ok := c.sleepsAt(server, at, groups); ok {
+			return at, info, true
+		}
+	}
+	return time.Time{}, serverSleepInfo{}, false
+}
+
+// sleepsAt is the evaluation of the sleep run at the given time, without the
+// checks needing Nova or only meaningful now, e.g. the task in progress.
+func (c *Cloud) sleepsAt(server servers.Server, at time.Time, groups map[string][]string) (serverSleepInfo, bool) {
+	if !c.sleepable(server) {
+		return serverSleepInfo{}, false
+	}
+	info, _, ok := sleepCandidate(server, at, c.policies)
+	if !ok || c.exclusionReason(server, at, groups) != "" || c.lock && isLocked(server) {
+		return serverSleepInfo{}, false
+	}
+	return info, true
+}
+
+// sleepable reports whether the status of the server is considered by the sleep run.
+func (c *Cloud) sleepable(server servers.Server) bool {
+	return server.Status == "ACTIVE" || server.Status == "SHUTOFF" && c.shelveShutoff
+}
+
+// plannedWake returns the awake time of a server put to sleep by pcd-vm-saver.
+func plannedWake(server servers.Server) (time.Time, bool) {
+	if _, owned := sleptAction(server.Metadata); !owned {
+		return time.Time{}, false
+	}
+	awakeTime, err := time.Parse(time.RFC3339, server.Metadata[util.AwakeTimeFilter])
+	return awakeTime, err == nil
+}
+
+// sleptServer returns the server as left by a successful sleep.
+func sleptServer(server servers.Server, info serverSleepInfo) servers.Server {
+	server.Status = "SHELVED_OFFLOADED"
+	if info.SuspendMode {
+		server.Status = "SUSPENDED"
+	}
+	server.Metadata = copyMetadata(info.NewMetadata)
+	server.Metadata[util.StateFilter] = string(StateAsleep)
+	return server
+}
+
+// wokenServer returns the server as left by a successful wake.
+func wokenServer(server servers.Server, info serverAwakeInfo, now time.Time) servers.Server {
+	server.Status = "ACTIVE"
+	if info.PowerOff {
+		server.Status = "SHUTOFF"
+	}
+	metadata := copyMetadata(server.Metadata)
+	for _, key := range scheduleKeys {
+		delete(metadata, key)
+	}
+	metadata[util.LastAwakeFilter] = now.Format(time.RFC3339)
+	for key, value := range stateMetadata(StateAwake, now) {
+		metadata[key] = value
+	}
+	server.Metadata = metadata
+	return server
+}
+
+func (c *Cloud) newEvent(server servers.Server, action string, at, now time.Time) Event {
+	return Event{
+		Cloud:   c.Name,
+		Project: c.projectOf(server),
+		Server:  server.Name,
+		ID:      server.ID,
+		Action:  action,
+		At:      at,
+		Now:     at.Equal(now),
+	}
+}
+
+// copyMetadata returns a copy of the metadata, never nil.
+func copyMetadata(metadata map[string]string) map[string]string {
+	copied := make(map[string]string, len(metadata)+2)
+	for key, value := range metadata {
+		copied[key] = value
+	}
+	return copied
+}
+
+// sortEvents orders the events by time, then by server name.
+func sortEvents(events []Event) {
+	slices.SortStableFunc(events, func(a, b Event) int {
+		return cmp.Or(a.At.Compare(b.At), strings.Compare(a.Server, b.Server))
+	})
+}
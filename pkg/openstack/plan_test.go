@@ -0,0 +1,103 @@
+package openstack
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/platform9/pcd-vm-saver/pkg/clock"
+	"github.com/platform9/pcd-vm-saver/pkg/selector"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// quietServers exercise every kind of skip of the sleep and awake evaluations.
+func quietServers() []fakeServer {
+	asleep := map[string]string{
+		"sleep_zone": "ist", "awake_time": "2026-10-20T08:30:00Z",
+		"vmsaver_slept_at": "2026-10-19T20:00:00Z", "vmsaver_action": "shelve", "vmsaver_state": "asleep",
+	}
+	return []fakeServer{
+		{ID: "1", Name: "vm", Status: "ACTIVE", Metadata: map[string]string{"sleep_zone": "ist"}},
+		{ID: "2", Name: "invalid", Status: "ACTIVE", Metadata: map[string]string{"sleep_zone": "mars"}},
+		{ID: "3", Name: "overridden", Status: "ACTIVE", Metadata: map[string]string{"sleep_zone": "ist", "save_sleep": "true"}},
+		{ID: "4", Name: "excluded", Status: "ACTIVE", Metadata: map[string]string{"sleep_zone": "ist"}},
+		{ID: "5", Name: "failed", Status: "ERROR", Metadata: map[string]string{"sleep_zone": "ist"}},
+		{ID: "6", Name: "asleep", Status: "SHELVED_OFFLOADED", Metadata: asleep},
+		// Checked for a manual wake
+		{ID: "7", Name: "woken", Status: "ACTIVE", Metadata: asleep},
+		{ID: "8", Name: "legacy", Status: "SHELVED_OFFLOADED", Metadata: map[string]string{"awake_time": "2026-10-20T08:30:00Z"}},
+		{ID: "9", Name: "bad awake time", Status: "SHELVED_OFFLOADED", Metadata: map[string]string{"awake_time": "tomorrow"}},
+		{ID: "10", Name: "selected", Status: "ACTIVE", Metadata: map[string]string{"env": "dev"}},
+	}
+}
+
+func quietRules(t *testing.T, cloud *Cloud) {
+	devSelector, err := selector.Parse("env=dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloud.policies = []SchedulePolicy{{Name: "dev", Selector: devSelector, Policy: mustPolicy(t, "zone", "us")}}
+	cloud.exclusions = []ExclusionRule{{Name: "excluded", NameRegex: regexp.MustCompile("^excluded$")}}
+}
+
+// The plans and simulations evaluate the schedules minute by minute, nothing
+// must be logged while doing so.
+func TestPlanQuiet(t *testing.T) {
+	now := time.Date(2026, 10, 19, 21, 0, 0, 0, time.UTC)
+	clk := clock.NewFake(now)
+	cloud := newTestCloud(t, newFakeNova(clk, quietServers()...))
+	quietRules(t, cloud)
+	// The inventory refresh logs, as it does for the runs
+	if _, err := cloud.inventory.Servers(context.Background(), clk); err != nil {
+		t.Fatal(err)
+	}
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	defer zap.ReplaceGlobals(zap.New(core))()
+	events, err := cloud.Plan(context.Background(), clk, 48*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) == 0 {
+		t.Error("no events planned")
+	}
+	if entries := logs.All(); len(entries) != 0 {
+		t.Errorf("%d log entries while planning, e.g. %q", len(entries), entries[0].Message)
+	}
+
+	// Whereas the sleep run reports the skips
+	if _, _, err := cloud.FetchVMsToSleep(context.Background(), clk); err != nil {
+		t.Fatal(err)
+	}
+	if logs.FilterMessageSnippet("Skipping server").Len() == 0 {
+		t.Error("the sleep run logged no skip")
+	}
+}
+
+func TestSimulateQuiet(t *testing.T) {
+	from := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)
+	clk := clock.NewFake(from)
+	cloud := NewOfflineCloud(CloudConfig{Name: "test"})
+	quietRules(t, cloud)
+	var serverList []servers.Server
+	for _, server := range quietServers() {
+		serverList = append(serverList, servers.Server{ID: server.ID, Name: server.Name, Status: server.Status, Metadata: server.Metadata})
+	}
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	defer zap.ReplaceGlobals(zap.New(core))()
+	sim, err := cloud.Simulate(context.Background(), clk, serverList, from, from.Add(7*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sim.Events) == 0 {
+		t.Error("no events simulated")
+	}
+	if entries := logs.All(); len(entries) != 0 {
+		t.Errorf("%d log entries while simulating, e.g. %q", len(entries), entries[0].Message)
+	}
+}
@@ -0,0 +1,143 @@
+package openstack
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/platform9/pcd-vm-saver/pkg/selector"
+)
+
+// Policy decides when a server sleeps. The zone and custom hours schedules
+// are policies, new kinds of schedules are added by registering a PolicyFactory.
+type Policy interface {
+	// Name describes the policy, e.g. "sleep_zone=ist"
+	Name() string
+	Evaluate(server servers.Server, now time.Time) Decision
+}
+
+// Decision is the verdict of a policy for a server at a given time.
+type Decision struct {
+	Sleep  bool
+	Reason string
+	// Suspend instead of shelve
+	SuspendMode bool
+	// When the server must be awakened, set when Sleep is
+	AwakeTime time.Time
+}
+
+// PolicyFactory builds a policy from its value, e.g. the value of its metadata
+// key.
+type PolicyFactory func(value string) (Policy, error)
+
+type policyKind struct {
+	kind        string
+	metadataKey string
+	factory     PolicyFactory
+}
+
+// Registered policy kinds, in order of precedence for the metadata keys.
+var policyKinds []policyKind
+
+// RegisterPolicy registers a kind of policy. Servers opt in to it by setting
+// metadataKey, policies in the configuration file by setting the kind. It is
+// meant to be called from init functions.
+func RegisterPolicy(kind, metadataKey string, factory PolicyFactory) {
+	for _, k := range policyKinds {
+		if k.kind == kind || (metadataKey != "" && k.metadataKey == metadataKey) {
+			panic(fmt.Sprintf("policy %s registered twice", kind))
+		}
+	}
+	policyKinds = append(policyKinds, policyKind{kind: kind, metadataKey: metadataKey, factory: factory})
+}
+
+// NewPolicy builds a policy of a registered kind.
+func NewPolicy(kind, value string) (Policy, error) {
+	for _, k := range policyKinds {
+		if k.kind == kind {
+			return k.factory(value)
+		}
+	}
+	return nil, fmt.Errorf("unknown policy kind %q", kind)
+}
+
+// metadataPolicy returns the policy configured in the server metadata, the
+// first valid one in order of registration. ok is false when the metadata
+// don't configure any, err is set when all the configured ones are invalid.
+func metadataPolicy(server servers.Server) (policy Policy, ok bool, err error) {
+	for _, k := range policyKinds {
+		value, exists := server.Metadata[k.metadataKey]
+		if k.metadataKey == "" || !exists {
+			continue
+		}
+		ok = true
+		p, perr := k.factory(value)
+		if perr != nil {
+			if err == nil {
+				err = fmt.Errorf("invalid %s value %q: %w", k.metadataKey, value, perr)
+			}
+			continue
+		}
+		return p, true, nil
+	}
+	return nil, ok, err
+}
+
+// SchedulePolicy applies a Policy to all the servers matched by its selector
+// and expression, so that whole groups of servers can be scheduled without
+// editing their metadata. The schedule of a server's own metadata takes
+// precedence.
+type SchedulePolicy struct {
+	Name     string
+	Selector selector.Selector
+	Expr     *ExprRule
+
+	Policy      Policy
+	SuspendMode bool
+}
+
+// Validate checks that the policy has a schedule and selects servers.
+func (p SchedulePolicy) Validate() error {
+	if p.Policy == nil {
+		return fmt.Errorf("no schedule set")
+	}
+	if p.Selector.Empty() && p.Expr == nil {
+		return fmt.Errorf("a selector or an expression is required")
+	}
+	return nil
+}
+
+// matches reports whether the policy applies to the server, err is set when
+// its expression can't be evaluated.
+func (p SchedulePolicy) matches(server servers.Server, labels map[string]string, now time.Time) (bool, error) {
+	if !p.Selector.Matches(labels) {
+		return false, nil
+	}
+	if p.Expr == nil {
+		return true, nil
+	}
+	matched, err := p.Expr.Eval(server, now)
+	if err != nil {
+		return false, fmt.Errorf("policy %q: %w", p.Name, err)
+	}
+	return matched, nil
+}
+
+// serverLabels returns the labels selectors are matched against: the server
+// metadata and its tags. A tag "key=value" is the label key with that value,
+// any other tag is a label with an empty value.
+func serverLabels(server servers.Server) map[string]string {
+	labels := make(map[string]string, len(server.Metadata))
+	if server.Tags != nil {
+		for _, tag := range *server.Tags {
+			key, value, _ := strings.Cut(tag, "=")
+			labels[key] = value
+		}
+	}
+	// Metadata win over tags
+	for key, value := range server.Metadata {
+		labels[key] = value
+	}
+	return labels
+}
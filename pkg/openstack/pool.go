@@ -0,0 +1,41 @@
+package openstack
+
+import (
+	"context"
+	"sync"
+)
+
+// forEach calls fn for every index in [0, n) using at most workers goroutines
+// and returns once all calls are done. Once ctx is done the remaining indexes
+// are not dispatched and ctx.Err() is returned, the calls in progress complete.
+func forEach(ctx context.Context, workers, n int, fn func(i int)) error {
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(max(workers, 1), n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+
+	var err error
+dispatch:
+	for i := 0; i < n; i++ {
+		// select picks randomly among the ready cases, check ctx first
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			break dispatch
+		case indexes <- i:
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	return err
+}
@@ -0,0 +1,105 @@
+package openstack
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForEachBound(t *testing.T) {
+	for _, workers := range []int{0, 1, 3, 20} {
+		var running, peak atomic.Int32
+		calls := make([]int32, 10)
+		err := forEach(context.Background(), workers, len(calls), func(i int) {
+			n := running.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&calls[i], 1)
+			running.Add(-1)
+		})
+		if err != nil {
+			t.Fatalf("%d workers: %v", workers, err)
+		}
+
+		if want := int32(min(max(workers, 1), len(calls))); peak.Load() > want {
+			t.Errorf("%d workers: %d calls ran concurrently, want at most %d", workers, peak.Load(), want)
+		}
+		for i, n := range calls {
+			if n != 1 {
+				t.Errorf("%d workers: index %d called %d times, want once", workers, i, n)
+			}
+		}
+	}
+}
+
+func TestForEachConcurrent(t *testing.T) {
+	// Every call waits for all the others, only returns if they run concurrently
+	const n = 4
+	var ready sync.WaitGroup
+	ready.Add(n)
+	done := make(chan struct{})
+	go func() {
+		forEach(context.Background(), n, n, func(i int) {
+			ready.Done()
+			ready.Wait()
+		})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the calls did not run concurrently")
+	}
+}
+
+// The results are collected by index, in the order of the input whatever the
+// order the calls complete in.
+func TestForEachResultOrder(t *testing.T) {
+	results := make([]int, 8)
+	forEach(context.Background(), 4, len(results), func(i int) {
+		time.Sleep(time.Duration(len(results)-i) * time.Millisecond)
+		results[i] = i * i
+	})
+	for i, got := range results {
+		if got != i*i {
+			t.Errorf("results[%d] = %d, want %d", i, got, i*i)
+		}
+	}
+}
+
+func TestForEachEmpty(t *testing.T) {
+	forEach(context.Background(), 5, 0, func(i int) { t.Errorf("called with %d", i) })
+}
+
+func TestForEachCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var called atomic.Int32
+	err := forEach(ctx, 2, 100, func(i int) {
+		if called.Add(1) == 3 {
+			cancel()
+		}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+	// The calls dispatched before the cancellation was seen complete
+	if n := called.Load(); n < 3 || n > 5 {
+		t.Errorf("%d calls, want the 3 up to the cancellation and at most one per worker more", n)
+	}
+}
+
+func TestForEachCanceledBefore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := forEach(ctx, 2, 10, func(i int) { t.Errorf("called with %d", i) }); err == nil {
+		t.Error("err = nil, want the context error")
+	}
+}
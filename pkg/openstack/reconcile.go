@@ -0,0 +1,149 @@
+package openstack
+
+import (
+	"context"
+	"maps"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/platform9/pcd-vm-saver/pkg/clock"
+	"github.com/platform9/pcd-vm-saver/pkg/result"
+	"github.com/platform9/pcd-vm-saver/pkg/util"
+	"go.uber.org/zap"
+)
+
+// ReconcileOpts selects the interrupted transitions Reconcile resumes, so that a
+// single awake pass does not put servers to sleep, and the other way around.
+type ReconcileOpts struct {
+	Sleeps bool // sleeping servers, sent to sleep again or persisted as asleep
+	Wakes  bool // waking servers, awakened again
+}
+
+// Reconcile resumes the transitions interrupted by a restart of pcd-vm-saver,
+// based on the state persisted in the server metadata:
+//   - sleeping and ACTIVE/SHUTOFF: the sleep action was never sent, it is sent again
+//     while the awake time is ahead unless the server was woken up manually,
+//     otherwise the awake scan cleans it up
+//   - sleeping and SUSPENDED: the asleep state is persisted, shelved servers
+//     keep the sleeping state until they are awakened
+//   - waking: the awake is done again
+//   - ERROR: the server is reported as failed
+//
+// Servers with a task in progress are left alone, their transition completes
+// without us. opts selects the transitions resumed, the failed servers are
+// always reported.
+func (c *Cloud) Reconcile(ctx context.Context, clk clock.Clock, opts ReconcileOpts) ([]result.VMResult, error) {
+	if c.DryRun {
+		zap.S().Infof("Dry run, not reconciling the VM states of cloud %s", c.Name)
+		return nil, nil
+	}
+
+	serverList, err := c.inventory.Servers(ctx, clk)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []result.VMResult
+	var sleepVMs []serverSleepInfo
+	var awakeVMs []serverAwakeInfo
+	now := clk.Now()
+	for _, server := range serverList {
+		stored, managed := server.Metadata[util.StateFilter]
+		if !managed || server.TaskState != "" {
+			continue
+		}
+		state := EffectiveState(server)
+
+		switch {
+		case server.Status == "ERROR" && state == StateFailed:
+			res := c.vmResult(server.Name, server.ID, c.projectOf(server), server.Status)
+			res.Action, res.Outcome, res.Reason = "reconcile", result.Failed, "server went to ERROR while "+stored
+			if server.Fault.Message != "" {
+				res.Reason += ": " + server.Fault.Message
+			}
+			results = append(results, res)
+
+		case VMState(stored) == StateSleeping && !opts.Sleeps, state == StateWaking && !opts.Wakes:
+			// Not selected, left for the job handling these transitions
+
+		case VMState(stored) == StateSleeping && (server.Status == "ACTIVE" || server.Status == "SHUTOFF"):
+			info, ok := interruptedSleep(server, now)
+			if !ok {
+				continue
+			}
+			if skip := c.checkManualWake(ctx, server, now); skip.kind != 0 {
+				results = append(results, *c.reportSkip(server, skip))
+				continue
+			}
+			info.ProjectID = c.projectOf(server)
+			sleepVMs = append(sleepVMs, info)
+
+		case VMState(stored) == StateSleeping && server.Status == "SUSPENDED":
+			res := c.vmResult(server.Name, server.ID, c.projectOf(server), server.Status)
+			res.Action, res.NewStatus = "reconcile", server.Status
+			if release, ok := c.claim(ctx, clk, server.ID, server.Status, server.Metadata, &res); ok {
+				res.Outcome = result.Acted
+				if err := c.setState(ctx, clk, server.ID, server.Status, state, StateAsleep); err != nil {
+					res.Outcome, res.Reason = result.Failed, err.Error()
+				}
+				release()
+			}
+			results = append(results, res)
+
+		case state == StateWaking:
+			action, owned := sleptAction(server.Metadata)
+			if !owned || (isLocked(server) && !lockedByUs(server)) {
+				continue
+			}
+			awakeVMs = append(awakeVMs, serverAwakeInfo{
+				Name:             server.Name,
+				ID:               server.ID,
+				ProjectID:        c.projectOf(server),
+				Status:           server.Status,
+				AvailabilityZone: server.AvailabilityZone,
+				State:            state,
+				Metadata:         server.Metadata,
+				SuspendMode:      action == "suspend",
+				Unlock:           needsUnlock(server),
+				AlreadyActive:    server.Status == "ACTIVE",
+			})
+		}
+	}
+
+	if len(sleepVMs) > 0 {
+		zap.S().Infof("Resuming %d interrupted sleep(s)", len(sleepVMs))
+		results = append(results, c.SleepVMs(ctx, clk, sleepVMs)...)
+	}
+	if len(awakeVMs) > 0 {
+		zap.S().Infof("Resuming %d interrupted awake(s)", len(awakeVMs))
+		results = append(results, c.AwakeVMs(ctx, clk, awakeVMs)...)
+	}
+	return results, nil
+}
+
+// interruptedSleep returns the sleep of an ACTIVE server left in the sleeping
+// state, when its awake time is still ahead. Should the sleep action fail again
+// the schedule and state keys are removed, leaving the server awake.
+func interruptedSleep(server servers.Server, now time.Time) (serverSleepInfo, bool) {
+	awakeTime, err := time.Parse(time.RFC3339, server.Metadata[util.AwakeTimeFilter])
+	if err != nil || !now.Before(awakeTime) {
+		return serverSleepInfo{}, false
+	}
+
+	oldMetadata := maps.Clone(server.Metadata)
+	for _, key := range append(scheduleKeys, util.StateFilter, util.StateSinceFilter) {
+		delete(oldMetadata, key)
+	}
+	return serverSleepInfo{
+		Name:        server.Name,
+		ID:          server.ID,
+		Status:      server.Status,
+		SuspendMode: server.Metadata[util.SleptActionFilter] == "suspend",
+		AwakeTime:   awakeTime,
+		Lock:        lockedByUs(server),
+		Metadata:    server.Metadata,
+		OldMetadata: oldMetadata,
+		NewMetadata: server.Metadata,
+		MetadataSet: true,
+	}, true
+}
@@ -0,0 +1,77 @@
+package openstack
+
+import (
+	"context"
+	"maps"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/platform9/pcd-vm-saver/pkg/clock"
+	"github.com/platform9/pcd-vm-saver/pkg/result"
+)
+
+func TestInterruptedSleep(t *testing.T) {
+	now := time.Date(2026, 10, 19, 20, 1, 0, 0, time.UTC)
+	server := servers.Server{ID: "id", Name: "vm", Status: "SHUTOFF", Metadata: map[string]string{
+		"sleep_zone":           "ist",
+		"awake_time":           "2026-10-20T08:30:00Z",
+		"vmsaver_slept_at":     "2026-10-19T20:00:00Z",
+		"vmsaver_action":       "shelve",
+		"vmsaver_prior_status": "SHUTOFF",
+		"vmsaver_locked":       "true",
+		"vmsaver_state":        "sleeping",
+		"vmsaver_state_since":  "2026-10-19T20:00:00Z",
+	}}
+
+	info, ok := interruptedSleep(server, now)
+	if !ok {
+		t.Fatal("interrupted sleep not resumed")
+	}
+	// Should the sleep fail again, the rollback leaves none of our keys
+	if want := map[string]string{"sleep_zone": "ist"}; !maps.Equal(info.OldMetadata, want) {
+		t.Errorf("OldMetadata = %v, want %v", info.OldMetadata, want)
+	}
+	if !info.MetadataSet || !info.Lock {
+		t.Errorf("MetadataSet = %t, Lock = %t, want both", info.MetadataSet, info.Lock)
+	}
+
+	// Past the awake time the awake scan cleans it up instead
+	if _, ok := interruptedSleep(server, now.Add(24*time.Hour)); ok {
+		t.Error("interrupted sleep resumed past its awake time")
+	}
+}
+
+// A single awake pass leaves the interrupted sleeps alone, failed servers are
+// still reported.
+func TestReconcileWakesOnly(t *testing.T) {
+	clk := clock.NewFake(time.Date(2026, 10, 19, 20, 1, 0, 0, time.UTC))
+	sleeping := map[string]string{
+		"sleep_zone":          "ist",
+		"awake_time":          "2026-10-20T08:30:00Z",
+		"vmsaver_slept_at":    "2026-10-19T20:00:00Z",
+		"vmsaver_action":      "suspend",
+		"vmsaver_state":       "sleeping",
+		"vmsaver_state_since": "2026-10-19T20:00:00Z",
+	}
+	nova := newFakeNova(clk,
+		fakeServer{ID: "active", Name: "active", Status: "ACTIVE", Metadata: sleeping},
+		fakeServer{ID: "suspended", Name: "suspended", Status: "SUSPENDED", Metadata: sleeping},
+		fakeServer{ID: "error", Name: "error", Status: "ERROR", Metadata: sleeping},
+	)
+	cloud := newTestCloud(t, nova)
+
+	results, err := cloud.Reconcile(context.Background(), clk, ReconcileOpts{Wakes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].ID != "error" || results[0].Outcome != result.Failed {
+		t.Errorf("results %v, want only the failed server", results)
+	}
+	for _, request := range nova.takeRequests() {
+		if !strings.HasPrefix(request, "GET ") {
+			t.Errorf("unexpected request %s", request)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package openstack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/platform9/pcd-vm-saver/pkg/clock"
+	"go.uber.org/zap"
+)
+
+// RetryPolicy controls how many times and how fast a failed API call is retried.
+type RetryPolicy struct {
+	Attempts       int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Jitter is the fraction of the backoff randomly added or removed, 0.2 means +/-20%.
+	Jitter float64
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:       5,
+	InitialBackoff: 2 * time.Second,
+	MaxBackoff:     30 * time.Second,
+	Jitter:         0.2,
+}
+
+// IsRetryable reports whether the error is transient and the call may succeed
+// if retried: conflicts because of a pending task_state, rate limiting, server
+// side errors and timeouts. Everything else, e.g. 403 and 404, is permanent.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var codeErr gophercloud.ErrUnexpectedResponseCode
+	if errors.As(err, &codeErr) {
+		switch {
+		case codeErr.Actual == http.StatusConflict,
+			codeErr.Actual == http.StatusTooManyRequests,
+			codeErr.Actual >= http.StatusInternalServerError:
+			return true
+		default:
+			return false
+		}
+	}
+
+	var timeoutErr gophercloud.ErrTimeOut
+	if errors.As(err, &timeoutErr) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// retry calls fn until it succeeds, fails with a permanent error or the policy
+// runs out of attempts. It returns the number of attempts made and the last error.
+func retry(ctx context.Context, clk clock.Clock, policy RetryPolicy, op string, fn func() error) (int, error) {
+	backoff := policy.InitialBackoff
+	attempt := 0
+	for {
+		attempt++
+		err := fn()
+		if err == nil {
+			return attempt, nil
+		}
+		if !IsRetryable(err) {
+			return attempt, err
+		}
+		if attempt >= policy.Attempts {
+			return attempt, fmt.Errorf("%s failed after %d attempts: %w", op, attempt, err)
+		}
+
+		wait := withJitter(backoff, policy.Jitter)
+		zap.S().Warnf("%s failed (attempt %d/%d), retrying in %s: %v", op, attempt, policy.Attempts, wait, err)
+		select {
+		case <-ctx.Done():
+			return attempt, ctx.Err()
+		case <-clk.After(wait):
+		}
+		backoff = min(backoff*2, policy.MaxBackoff)
+	}
+}
+
+func withJitter(d time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return d
+	}
+	delta := (rand.Float64()*2 - 1) * jitter * float64(d)
+	return d + time.Duration(delta)
+}
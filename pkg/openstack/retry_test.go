@@ -0,0 +1,187 @@
+package openstack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/platform9/pcd-vm-saver/pkg/clock"
+)
+
+// timeoutError is a net.Error as returned by the HTTP client on a dial or read timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func responseCode(code int) error {
+	return gophercloud.ErrUnexpectedResponseCode{Method: "POST", Actual: code}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"409 task_state pending", responseCode(http.StatusConflict), true},
+		{"429 rate limited", responseCode(http.StatusTooManyRequests), true},
+		{"500", responseCode(http.StatusInternalServerError), true},
+		{"502", responseCode(http.StatusBadGateway), true},
+		{"503", responseCode(http.StatusServiceUnavailable), true},
+		{"504", responseCode(http.StatusGatewayTimeout), true},
+		{"400", responseCode(http.StatusBadRequest), false},
+		{"403", responseCode(http.StatusForbidden), false},
+		{"404", responseCode(http.StatusNotFound), false},
+		{"wrapped 503", fmt.Errorf("shelve: %w", responseCode(http.StatusServiceUnavailable)), true},
+		{"wrapped 404", fmt.Errorf("shelve: %w", responseCode(http.StatusNotFound)), false},
+		{"gophercloud timeout", gophercloud.ErrTimeOut{}, true},
+		{"deadline exceeded", fmt.Errorf("get server: %w", context.DeadlineExceeded), true},
+		{"network timeout", &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, true},
+		{"connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{"cancelled", context.Canceled, false},
+		{"other", errors.New("invalid metadata"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	policy := RetryPolicy{Attempts: 5, InitialBackoff: time.Second, MaxBackoff: 4 * time.Second}
+	unavailable := responseCode(http.StatusServiceUnavailable)
+
+	tests := []struct {
+		name     string
+		errs     []error // returned by the successive calls, nil once exhausted
+		attempts int
+		calls    []time.Duration // since the start
+		code     int             // of the error returned, 0 for none
+	}{
+		{
+			name:     "first attempt",
+			attempts: 1,
+			calls:    []time.Duration{0},
+		},
+		{
+			name:     "transient",
+			errs:     []error{unavailable, responseCode(http.StatusConflict)},
+			attempts: 3,
+			calls:    []time.Duration{0, time.Second, 3 * time.Second},
+		},
+		{
+			name:     "permanent",
+			errs:     []error{responseCode(http.StatusForbidden)},
+			attempts: 1,
+			calls:    []time.Duration{0},
+			code:     http.StatusForbidden,
+		},
+		{
+			name:     "permanent after transient",
+			errs:     []error{unavailable, responseCode(http.StatusNotFound)},
+			attempts: 2,
+			calls:    []time.Duration{0, time.Second},
+			code:     http.StatusNotFound,
+		},
+		{
+			// 1s, 2s, then capped at 4s
+			name:     "out of attempts",
+			errs:     slices.Repeat([]error{unavailable}, 10),
+			attempts: 5,
+			calls:    []time.Duration{0, time.Second, 3 * time.Second, 7 * time.Second, 11 * time.Second},
+			code:     http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Date(2026, 10, 19, 20, 1, 0, 0, time.UTC)
+			clk := clock.NewFake(start)
+			var mu sync.Mutex
+			var calls []time.Duration
+
+			var attempts int
+			var err error
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				attempts, err = retry(context.Background(), clk, policy, "shelve", func() error {
+					mu.Lock()
+					defer mu.Unlock()
+					calls = append(calls, clk.Now().Sub(start))
+					if len(calls) <= len(tt.errs) {
+						return tt.errs[len(calls)-1]
+					}
+					return nil
+				})
+			}()
+			drive(clk, done, time.Second)
+
+			if attempts != tt.attempts {
+				t.Errorf("%d attempts, want %d", attempts, tt.attempts)
+			}
+			switch {
+			case tt.code == 0 && err != nil:
+				t.Errorf("err = %v, want none", err)
+			case tt.code != 0 && !gophercloud.ResponseCodeIs(err, tt.code):
+				t.Errorf("err = %v, want a %d", err, tt.code)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !slices.Equal(calls, tt.calls) {
+				t.Errorf("called at %v, want %v", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestRetryCancelled(t *testing.T) {
+	clk := clock.NewFake(time.Date(2026, 10, 19, 20, 1, 0, 0, time.UTC))
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	done := make(chan struct{})
+	var attempts int
+	var err error
+	go func() {
+		defer close(done)
+		attempts, err = retry(ctx, clk, DefaultRetryPolicy, "shelve", func() error {
+			calls++
+			return responseCode(http.StatusServiceUnavailable)
+		})
+	}()
+
+	// Cancel while the first backoff is pending, the clock never moves
+	clk.BlockUntil(1)
+	cancel()
+	<-done
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+	if attempts != 1 || calls != 1 {
+		t.Errorf("%d attempts and %d calls, want 1", attempts, calls)
+	}
+}
+
+func TestWithJitter(t *testing.T) {
+	if got := withJitter(10*time.Second, 0); got != 10*time.Second {
+		t.Errorf("withJitter(10s, 0) = %s, want 10s", got)
+	}
+	for i := 0; i < 100; i++ {
+		if got := withJitter(10*time.Second, 0.2); got < 8*time.Second || got > 12*time.Second {
+			t.Fatalf("withJitter(10s, 0.2) = %s, want within 8s and 12s", got)
+		}
+	}
+}
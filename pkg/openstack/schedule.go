@@ -0,0 +1,303 @@
+package openstack
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/platform9/pcd-vm-saver/pkg/util"
+)
+
+// ZoneWindow returns the sleep and awake time of the zone window that starts on
+// the day of now. Times are computed in the location of now.
+func ZoneWindow(zone string, now time.Time) (sleepTime, awakeTime time.Time, ok bool) {
+	switch zone {
+	case util.IndiaSleepVal:
+		// For India, sleep at 8 PM and awake at 8:30 AM
+		sleepTime = time.Date(now.Year(), now.Month(), now.Day(), 20, 0, 0, 0, now.Location())
+		awakeTime = time.Date(now.Year(), now.Month(), now.Day()+1, 8, 30, 0, 0, now.Location())
+	case util.USSleepVal:
+		// For US, sleep at 8 AM and awake at 8:30 PM
+		sleepTime = time.Date(now.Year(), now.Month(), now.Day(), 8, 0, 0, 0, now.Location())
+		awakeTime = time.Date(now.Year(), now.Month(), now.Day(), 20, 30, 0, 0, now.Location())
+	default:
+		return sleepTime, awakeTime, false
+	}
+	return sleepTime, awakeTime, true
+}
+
+func init() {
+	RegisterPolicy("zone", util.DefaultSleepFilter, newZonePolicy)
+	RegisterPolicy("hours", util.CustomSleepFilter, newHoursPolicy)
+}
+
+// zonePolicy sleeps the server during the window of its zone.
+type zonePolicy struct {
+	zone string
+}
+
+func newZonePolicy(zone string) (Policy, error) {
+	if _, _, ok := ZoneWindow(zone, time.Time{}); !ok {
+		return nil, fmt.Errorf("unknown zone %q", zone)
+	}
+	return zonePolicy{zone: zone}, nil
+}
+
+func (p zonePolicy) Name() string {
+	return util.DefaultSleepFilter + "=" + p.zone
+}
+
+func (p zonePolicy) Evaluate(server servers.Server, now time.Time) Decision {
+	sleepTime, awakeTime, _ := ZoneWindow(p.zone, now)
+	window := fmt.Sprintf("%s window %s - %s", p.zone, sleepTime.Format(time.RFC3339), awakeTime.Format(time.RFC3339))
+
+	// Check if current time is between sleep and awake time
+	if !(now.After(sleepTime) && now.Before(awakeTime)) {
+		return Decision{Reason: "outside the " + window}
+	}
+	return Decision{
+		Sleep:  true,
+		Reason: "within the " + window,
+		// If SleepModeFilter is set to ram_preserve, we need to consider it suspend instead of shelve
+		SuspendMode: server.Metadata[util.SleepModeFilter] == "true",
+		AwakeTime:   awakeTime,
+	}
+}
+
+// hoursPolicy sleeps the server for a number of hours once it is older than
+// that. The server is always shelved.
+type hoursPolicy struct {
+	hours time.Duration
+}
+
+func newHoursPolicy(value string) (Policy, error) {
+	hours, err := time.ParseDuration(value + "h")
+	if err != nil {
+		return nil, fmt.Errorf("invalid number of hours %q", value)
+	}
+	return hoursPolicy{hours: hours}, nil
+}
+
+func (p hoursPolicy) Name() string {
+	return fmt.Sprintf("%s=%g", util.CustomSleepFilter, p.hours.Hours())
+}
+
+func (p hoursPolicy) Evaluate(server servers.Server, now time.Time) Decision {
+	// Difference
+	elapsed := now.Sub(server.Created)
+	if elapsed < p.hours {
+		return Decision{Reason: fmt.Sprintf("created %s ago, sleeps once older than %s", elapsed.Round(time.Minute), p.hours)}
+	}
+	return Decision{
+		Sleep:     true,
+		Reason:    fmt.Sprintf("created more than %s ago", p.hours),
+		AwakeTime: now.Add(p.hours),
+	}
+}
+
+// schedule is the sleep schedule of a server, from its metadata or from the
+// first policy selecting it.
+type schedule struct {
+	Policy      Policy
+	SuspendMode bool   // Forced by the selecting policy
+	Source      string // metadata, or the name of the selecting policy
+}
+
+// scheduleOf returns the schedule of the server. The metadata of the server
+// take precedence over the policies. ok is false when the server has no
+// schedule, err is set when its schedule is invalid.
+func scheduleOf(server servers.Server, now time.Time, policies []SchedulePolicy) (sched schedule, ok bool, err error) {
+	if policy, ok, err := metadataPolicy(server); ok {
+		return schedule{Policy: policy, Source: "metadata"}, true, err
+	}
+
+	labels := serverLabels(server)
+	for _, policy := range policies {
+		matched, err := policy.matches(server, labels, now)
+		if err != nil {
+			// Rather keep the server awake when the policy can't be evaluated
+			return schedule{Source: "policy " + policy.Name}, true, err
+		}
+		if matched {
+			return schedule{Policy: policy.Policy, SuspendMode: policy.SuspendMode, Source: "policy " + policy.Name}, true, nil
+		}
+	}
+	return schedule{}, false, nil
+}
+
+// skipKind tells how the runs report a server they don't act upon.
+type skipKind int
+
+const (
+	// Nothing to do yet, e.g. outside the sleep window, not reported
+	skipNotDue skipKind = iota + 1
+	// The server is deliberately left alone, e.g. excluded or overridden
+	skipLeftAlone
+	// The schedule of the server or a check could not be evaluated
+	skipFailed
+	// The server is in ERROR
+	skipNeedsAttention
+)
+
+// skip is why a server is not slept or awakened. The zero skip is that of a
+// server without schedule nor awake time, there is nothing to tell about it.
+// The evaluations don't log anything, the runs log and report the skips while
+// the plans and simulations evaluating every minute stay silent.
+type skip struct {
+	kind   skipKind
+	reason string
+}
+
+// sleepCandidate decides from its schedule and state whether the server needs
+// to sleep at the given time. When it does not, skip tells why.
+func sleepCandidate(server servers.Server, now time.Time, policies []SchedulePolicy) (serverSleepInfo, skip, bool) {
+	sched, scheduled, err := scheduleOf(server, now, policies)
+	// Only check those servers which have a schedule
+	if !scheduled {
+		return serverSleepInfo{}, skip{}, false
+	}
+
+	// Check if OverrideSleepFilter is set to true
+	if overrideSleepVal, exists := server.Metadata[util.OverrideSleepFilter]; exists && overrideSleepVal == "true" {
+		return serverSleepInfo{}, skip{skipLeftAlone, util.OverrideSleepFilter + " is set"}, false
+	}
+
+	// The server must be in a state it can be put to sleep from
+	if state := EffectiveState(server); !canTransition(state, StateSleeping) {
+		return serverSleepInfo{}, skip{skipLeftAlone, fmt.Sprintf("server is in %s state", state)}, false
+	}
+
+	if err != nil {
+		return serverSleepInfo{}, skip{skipFailed, err.Error()}, false
+	}
+
+	policy := sched.Policy.Name() + " (" + sched.Source + ")"
+	decision := sched.Policy.Evaluate(server, now)
+	if !decision.Sleep {
+		return serverSleepInfo{}, skip{skipNotDue, fmt.Sprintf("not eligible for sleep based on %s: %s", policy, decision.Reason)}, false
+	}
+
+	suspendMode := decision.SuspendMode || sched.SuspendMode
+	// There is no RAM to preserve on a powered off server, and it can't be suspended
+	if server.Status == "SHUTOFF" {
+		suspendMode = false
+	}
+
+	return serverSleepInfo{
+		Name:        server.Name,
+		ID:          server.ID,
+		Status:      server.Status,
+		Policy:      policy,
+		Reason:      decision.Reason,
+		SuspendMode: suspendMode,
+		AwakeTime:   decision.AwakeTime,
+		Metadata:    server.Metadata,
+		OldMetadata: server.Metadata,
+		NewMetadata: sleepMetadata(server, decision.AwakeTime, now, suspendMode),
+	}, skip{}, true
+}
+
+// awakeCandidate decides whether the server needs to be awakened at the given
+// time. When it does not, skip tells why.
+func awakeCandidate(server servers.Server, now time.Time) (serverAwakeInfo, skip, bool) {
+	// Check for AwakeTimeFilter
+	awakeTimeStr, exists := server.Metadata[util.AwakeTimeFilter]
+	if !exists {
+		return serverAwakeInfo{}, skip{}, false
+	}
+
+	awakeTime, err := time.Parse(time.RFC3339, awakeTimeStr)
+	if err != nil {
+		return serverAwakeInfo{}, skip{skipFailed, fmt.Sprintf("invalid %s value %q", util.AwakeTimeFilter, awakeTimeStr)}, false
+	}
+
+	if !now.After(awakeTime) {
+		return serverAwakeInfo{}, skip{skipNotDue, "not yet ready to awake, awake time: " + awakeTime.Format(time.RFC3339)}, false
+	}
+
+	// Only wake the servers we put to sleep, and only from the state we left
+	// them in. A user may have shelved the server or copied the metadata.
+	alreadyActive := server.Status == "ACTIVE"
+	action, owned := sleptAction(server.Metadata)
+	if !owned {
+		if alreadyActive {
+			return serverAwakeInfo{}, skip{}, false
+		}
+		return serverAwakeInfo{}, skip{skipLeftAlone, fmt.Sprintf("%s is set but the server was not put to sleep by pcd-vm-saver", util.AwakeTimeFilter)}, false
+	}
+	if !alreadyActive && !slices.Contains(sleptStatuses[action], server.Status) {
+		return serverAwakeInfo{}, skip{skipLeftAlone, fmt.Sprintf("server is %s, not in the state left by %s", server.Status, action)}, false
+	}
+	if isLocked(server) && !lockedByUs(server) {
+		return serverAwakeInfo{}, skip{skipLeftAlone, "server is locked by someone else"}, false
+	}
+
+	// The server can't be acted upon until its task completes. When ACTIVE this
+	// is a stale awake timestamp, only its metadata needs to be cleaned up.
+	if server.TaskState != "" {
+		return serverAwakeInfo{}, skip{skipLeftAlone, fmt.Sprintf("task %s in progress", server.TaskState)}, false
+	}
+
+	return serverAwakeInfo{
+		Name:             server.Name,
+		ID:               server.ID,
+		Status:           server.Status,
+		AvailabilityZone: server.AvailabilityZone,
+		State:            EffectiveState(server),
+		Metadata:         server.Metadata,
+		SuspendMode:      action == "suspend",
+		Unlock:           needsUnlock(server),
+		PowerOff:         server.Metadata[util.PriorStatusFilter] == "SHUTOFF",
+		AlreadyActive:    alreadyActive,
+	}, skip{}, true
+}
+
+// hasSchedule reports whether the server has a sleep schedule, or was put to
+// sleep by a previous schedule.
+func hasSchedule(server servers.Server, now time.Time, policies []SchedulePolicy) bool {
+	if _, exists := server.Metadata[util.AwakeTimeFilter]; exists {
+		return true
+	}
+	_, ok, _ := scheduleOf(server, now, policies)
+	return ok
+}
+
+// Statuses a server is left in by each sleep action.
+var sleptStatuses = map[string][]string{
+	"shelve":  {"SHELVED_OFFLOADED", "SHELVED"},
+	"suspend": {"SUSPENDED"},
+}
+
+// sleptAction returns the sleep action recorded by the ownership marker, ok is
+// false when pcd-vm-saver did not put the server to sleep.
+func sleptAction(metadata map[string]string) (action string, ok bool) {
+	if _, exists := metadata[util.SleptAtFilter]; !exists {
+		return "", false
+	}
+	action = metadata[util.SleptActionFilter]
+	_, ok = sleptStatuses[action]
+	return action, ok
+}
+
+// sleepMetadata returns a copy of the server metadata with the AwakeTimeFilter
+// and the ownership marker set and the server moved to the sleeping state.
+func sleepMetadata(server servers.Server, awakeTime, now time.Time, suspendMode bool) map[string]string {
+	action := "shelve"
+	if suspendMode {
+		action = "suspend"
+	}
+
+	newMetadata := make(map[string]string, len(server.Metadata)+6)
+	for key, value := range server.Metadata {
+		newMetadata[key] = value
+	}
+	newMetadata[util.AwakeTimeFilter] = awakeTime.Format(time.RFC3339)
+	newMetadata[util.SleptAtFilter] = now.Format(time.RFC3339)
+	newMetadata[util.SleptActionFilter] = action
+	newMetadata[util.PriorStatusFilter] = server.Status
+	for key, value := range stateMetadata(StateSleeping, now) {
+		newMetadata[key] = value
+	}
+	return newMetadata
+}
@@ -0,0 +1,197 @@
+package openstack
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/platform9/pcd-vm-saver/pkg/clock"
+	"github.com/platform9/pcd-vm-saver/pkg/selector"
+)
+
+func mustPolicy(t *testing.T, kind, value string) Policy {
+	t.Helper()
+	policy, err := NewPolicy(kind, value)
+	if err != nil {
+		t.Fatalf("NewPolicy(%q, %q): %v", kind, value, err)
+	}
+	return policy
+}
+
+func mustLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("time zone %s not available: %v", name, err)
+	}
+	return loc
+}
+
+func TestZonePolicy(t *testing.T) {
+	newYork := mustLocation(t, "America/New_York")
+	tests := []struct {
+		name      string
+		zone      string
+		at        time.Time
+		sleep     bool
+		awakeTime time.Time
+	}{
+		{"ist before the window", "ist", time.Date(2026, 10, 19, 19, 59, 0, 0, time.UTC), false, time.Time{}},
+		{"ist window opens after 20:00", "ist", time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC), false, time.Time{}},
+		{"ist within the window", "ist", time.Date(2026, 10, 19, 20, 1, 0, 0, time.UTC), true, time.Date(2026, 10, 20, 8, 30, 0, 0, time.UTC)},
+		{"ist before midnight", "ist", time.Date(2026, 10, 19, 23, 59, 0, 0, time.UTC), true, time.Date(2026, 10, 20, 8, 30, 0, 0, time.UTC)},
+		{"us before the window", "us", time.Date(2026, 10, 19, 7, 59, 0, 0, time.UTC), false, time.Time{}},
+		{"us within the window", "us", time.Date(2026, 10, 19, 8, 1, 0, 0, time.UTC), true, time.Date(2026, 10, 19, 20, 30, 0, 0, time.UTC)},
+		{"us window closed", "us", time.Date(2026, 10, 19, 20, 30, 0, 0, time.UTC), false, time.Time{}},
+		// The awake time is a wall clock time, the window is an hour longer when DST ends
+		{"ist window across DST end", "ist", time.Date(2026, 10, 31, 21, 0, 0, 0, newYork), true, time.Date(2026, 11, 1, 8, 30, 0, 0, newYork)},
+		{"ist window across DST start", "ist", time.Date(2026, 3, 7, 21, 0, 0, 0, newYork), true, time.Date(2026, 3, 8, 8, 30, 0, 0, newYork)},
+	}
+
+	clk := clock.NewFake(time.Time{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clk.Set(tt.at)
+			decision := mustPolicy(t, "zone", tt.zone).Evaluate(servers.Server{}, clk.Now())
+			if decision.Sleep != tt.sleep {
+				t.Fatalf("Sleep = %t, want %t (%s)", decision.Sleep, tt.sleep, decision.Reason)
+			}
+			if !decision.AwakeTime.Equal(tt.awakeTime) {
+				t.Errorf("AwakeTime = %s, want %s", decision.AwakeTime, tt.awakeTime)
+			}
+		})
+	}
+}
+
+func TestZonePolicyDSTWindowLength(t *testing.T) {
+	newYork := mustLocation(t, "America/New_York")
+	tests := []struct {
+		day    time.Time
+		length time.Duration
+	}{
+		{time.Date(2026, 10, 31, 0, 0, 0, 0, newYork), 13*time.Hour + 30*time.Minute},
+		{time.Date(2026, 3, 7, 0, 0, 0, 0, newYork), 11*time.Hour + 30*time.Minute},
+		{time.Date(2026, 6, 1, 0, 0, 0, 0, newYork), 12*time.Hour + 30*time.Minute},
+	}
+	for _, tt := range tests {
+		sleepTime, awakeTime, ok := ZoneWindow("ist", tt.day)
+		if !ok {
+			t.Fatal("ZoneWindow(ist) not ok")
+		}
+		if got := awakeTime.Sub(sleepTime); got != tt.length {
+			t.Errorf("window of %s lasts %s, want %s", tt.day.Format(time.DateOnly), got, tt.length)
+		}
+	}
+}
+
+func TestZonePolicyFirstSleepMinute(t *testing.T) {
+	policy := mustPolicy(t, "zone", "ist")
+	clk := clock.NewFake(time.Date(2026, 10, 19, 19, 55, 0, 0, time.UTC))
+	for i := 0; i < 10; i++ {
+		if policy.Evaluate(servers.Server{}, clk.Now()).Sleep {
+			break
+		}
+		clk.Advance(time.Minute)
+	}
+	if want := time.Date(2026, 10, 19, 20, 1, 0, 0, time.UTC); !clk.Now().Equal(want) {
+		t.Errorf("first sleep at %s, want %s", clk.Now(), want)
+	}
+}
+
+func TestNewZonePolicyUnknownZone(t *testing.T) {
+	if _, err := NewPolicy("zone", "mars"); err == nil {
+		t.Error("NewPolicy(zone, mars) succeeded, want an error")
+	}
+}
+
+func TestHoursPolicy(t *testing.T) {
+	created := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		age   time.Duration
+		sleep bool
+	}{
+		{"younger", 3*time.Hour + 59*time.Minute, false},
+		{"exactly the hours", 4 * time.Hour, true},
+		{"older", 30 * time.Hour, true},
+	}
+
+	clk := clock.NewFake(created)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clk.Set(created.Add(tt.age))
+			decision := mustPolicy(t, "hours", "4").Evaluate(servers.Server{Created: created}, clk.Now())
+			if decision.Sleep != tt.sleep {
+				t.Fatalf("Sleep = %t, want %t (%s)", decision.Sleep, tt.sleep, decision.Reason)
+			}
+			if tt.sleep && !decision.AwakeTime.Equal(clk.Now().Add(4*time.Hour)) {
+				t.Errorf("AwakeTime = %s, want 4 hours after %s", decision.AwakeTime, clk.Now())
+			}
+		})
+	}
+}
+
+func TestSleepCandidate(t *testing.T) {
+	devSelector, err := selector.Parse("env=dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies := []SchedulePolicy{{
+		Name:        "dev",
+		Selector:    devSelector,
+		Policy:      mustPolicy(t, "zone", "us"),
+		SuspendMode: true,
+	}}
+	night := time.Date(2026, 10, 19, 21, 0, 0, 0, time.UTC)
+	morning := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		status   string
+		metadata map[string]string
+		at       time.Time
+		ok       bool
+		skip     skipKind
+		reason   string // substring of the skip reason
+		suspend  bool
+	}{
+		{"no schedule", "ACTIVE", map[string]string{"env": "prod"}, night, false, 0, "", false},
+		{"zone window", "ACTIVE", map[string]string{"sleep_zone": "ist"}, night, true, 0, "", false},
+		{"outside the zone window", "ACTIVE", map[string]string{"sleep_zone": "ist"}, morning, false, skipNotDue, "outside the ist window", false},
+		{"ram preserved", "ACTIVE", map[string]string{"sleep_zone": "ist", "ram_preserve": "true"}, night, true, 0, "", true},
+		{"SHUTOFF is shelved", "SHUTOFF", map[string]string{"sleep_zone": "ist", "ram_preserve": "true"}, night, true, 0, "", false},
+		{"override", "ACTIVE", map[string]string{"sleep_zone": "ist", "save_sleep": "true"}, night, false, skipLeftAlone, "save_sleep", false},
+		{"being awakened", "ACTIVE", map[string]string{"sleep_zone": "ist", "vmsaver_state": "waking"}, night, false, skipLeftAlone, "waking", false},
+		{"invalid zone", "ACTIVE", map[string]string{"sleep_zone": "mars"}, night, false, skipFailed, "mars", false},
+		{"selected by policy", "ACTIVE", map[string]string{"env": "dev"}, morning, true, 0, "", true},
+		{"metadata before policy", "ACTIVE", map[string]string{"env": "dev", "sleep_zone": "ist"}, morning, false, skipNotDue, "sleep_zone=ist (metadata)", false},
+	}
+
+	clk := clock.NewFake(time.Time{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clk.Set(tt.at)
+			server := servers.Server{ID: "id", Name: "vm", Status: tt.status, Metadata: tt.metadata}
+			info, skip, ok := sleepCandidate(server, clk.Now(), policies)
+			if ok != tt.ok {
+				t.Fatalf("ok = %t, want %t (skip %q)", ok, tt.ok, skip.reason)
+			}
+			if skip.kind != tt.skip || !strings.Contains(skip.reason, tt.reason) || tt.skip == 0 && skip.reason != "" {
+				t.Errorf("skip = %d %q, want %d containing %q", skip.kind, skip.reason, tt.skip, tt.reason)
+			}
+			if !ok {
+				return
+			}
+			if info.Policy == "" || info.Reason == "" {
+				t.Errorf("Policy = %q, Reason = %q, want the deciding policy and its reason", info.Policy, info.Reason)
+			}
+			if info.SuspendMode != tt.suspend {
+				t.Errorf("SuspendMode = %t, want %t", info.SuspendMode, tt.suspend)
+			}
+			if info.NewMetadata["vmsaver_state"] != string(StateSleeping) || info.NewMetadata["vmsaver_prior_status"] != tt.status {
+				t.Errorf("NewMetadata = %v, want the sleeping state and prior status %s", info.NewMetadata, tt.status)
+			}
+		})
+	}
+}
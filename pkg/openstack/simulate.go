@@ -0,0 +1,232 @@
+package openstack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/platform9/pcd-vm-saver/pkg/clock"
+	"go.uber.org/zap"
+)
+
+// Simulation is the timeline of the sleeps and wakes planned by the schedules
+// over a time range, with the resources they release.
+type Simulation struct {
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	Events  []Event   `json:"events"`
+	Savings []Savings `json:"savings"` // Servers asleep during the range only
+}
+
+// Savings are the resources released by one server, or by all of them, while
+// asleep during a simulation.
+type Savings struct {
+	Cloud       string  `json:"cloud,omitempty"`
+	Project     string  `json:"project,omitempty"`
+	Server      string  `json:"server,omitempty"`
+	ID          string  `json:"id,omitempty"`
+	Sleeps      int     `json:"sleeps"`
+	AsleepHours float64 `json:"asleep_hours"`
+	VCPUHours   float64 `json:"vcpu_hours"`
+	RAMGBHours  float64 `json:"ram_gb_hours"`
+	// The flavor size is only known when embedded in the server, since
+	// compute microversion 2.47. Unknown sizes release nothing.
+	UnknownSize int `json:"unknown_size,omitempty"`
+}
+
+// Servers returns the current servers of the cloud, as evaluated by the sleep
+// and awake runs.
+func (c *Cloud) Servers(ctx context.Context, clk clock.Clock) ([]servers.Server, error) {
+	return c.inventory.Servers(ctx, clk)
+}
+
+// Simulate replays the schedules over the servers from from to to. When from
+// is ahead, the servers are first brought to their planned state at from. The
+// simulation assumes every planned action succeeds and nobody else acts on
+// the servers. Offline clouds ignore the server group exclusion rules.
+func (c *Cloud) Simulate(ctx context.Context, clk clock.Clock, serverList []servers.Server, from, to time.Time) (*Simulation, error) {
+	if !to.After(from) {
+		return nil, fmt.Errorf("the end of the simulation %s is not after its start %s", to.Format(time.RFC3339), from.Format(time.RFC3339))
+	}
+
+	var groups map[string][]string
+	if c.compute != nil {
+		var err error
+		if groups, err = c.serverGroups(ctx); err != nil {
+			return nil, err
+		}
+	} else if slices.ContainsFunc(c.exclusions, func(rule ExclusionRule) bool { return len(rule.ServerGroups) > 0 }) {
+		zap.S().Warnf("Cloud %s: server groups are unknown offline, server group exclusion rules never match", c.Name)
+	}
+
+	// Only the decisions of the current run can be evaluated against Nova
+	now := clk.Now()
+	start := from
+	if from.After(now) {
+		start = now
+	}
+	live := c.compute != nil && start.Equal(now)
+
+	sim := &Simulation{From: from, To: to}
+	for _, server := range serverList {
+		server, _ = c.adoptLegacy(server, start)
+		events := c.simulate(ctx, server, start, to, groups, live)
+		savings := serverSavings(server, events, start, from, to)
+		if savings.AsleepHours > 0 {
+			savings.Cloud, savings.Project, savings.Server, savings.ID = c.Name, c.projectOf(server), server.Name, server.ID
+			sim.Savings = append(sim.Savings, savings)
+		}
+		for _, event := range events {
+			if !event.At.Before(from) {
+				sim.Events = append(sim.Events, event)
+			}
+		}
+	}
+	sortEvents(sim.Events)
+	return sim, nil
+}
+
+// Add merges the events and savings of other, simulated over the same range.
+func (s *Simulation) Add(other *Simulation) {
+	s.Events = append(s.Events, other.Events...)
+	s.Savings = append(s.Savings, other.Savings...)
+	sortEvents(s.Events)
+}
+
+// Total sums the savings of all the servers.
+func (s *Simulation) Total() Savings {
+	var total Savings
+	for _, savings := range s.Savings {
+		total.Sleeps += savings.Sleeps
+		total.AsleepHours += savings.AsleepHours
+		total.VCPUHours += savings.VCPUHours
+		total.RAMGBHours += savings.RAMGBHours
+		total.UnknownSize += savings.UnknownSize
+	}
+	return total
+}
+
+// serverSavings computes the time the server spends asleep between from and
+// to, given its events simulated since start.
+func serverSavings(server servers.Server, events []Event, start, from, to time.Time) Savings {
+	var savings Savings
+	var asleep time.Duration
+	since, sleeping := start, asleepNow(server)
+	for _, event := range events {
+		switch event.Action {
+		case "shelve", "suspend":
+			since, sleeping = event.At, true
+			if !event.At.Before(from) {
+				savings.Sleeps++
+			}
+		default:
+			asleep += overlap(since, event.At, from, to)
+			sleeping = false
+		}
+	}
+	if sleeping {
+		asleep += overlap(since, to, from, to)
+	}
+	if asleep == 0 {
+		return savings
+	}
+
+	savings.AsleepHours = asleep.Hours()
+	if _, known := server.Flavor["vcpus"]; !known {
+		savings.UnknownSize = 1
+		return savings
+	}
+	savings.VCPUHours = savings.AsleepHours * float64(flavorInt(server, "vcpus"))
+	savings.RAMGBHours = savings.AsleepHours * float64(flavorInt(server, "ram")) / 1024
+	return savings
+}
+
+// asleepNow reports whether the server is asleep, put to sleep by pcd-vm-saver.
+func asleepNow(server servers.Server) bool {
+	action, owned := sleptAction(server.Metadata)
+	return owned && slices.Contains(sleptStatuses[action], server.Status)
+}
+
+// overlap returns the duration of [start, end] within [from, to].
+func overlap(start, end, from, to time.Time) time.Duration {
+	if start.Before(from) {
+		start = from
+	}
+	if end.After(to) {
+		end = to
+	}
+	return max(end.Sub(start), 0)
+}
+
+// inventoryFile is the format of the saved inventories, that of the Nova
+// servers detailed listing.
+type inventoryFile struct {
+	Servers []inventoryServer `json:"servers"`
+}
+
+// inventoryServer encodes a server as Nova lists it. servers.Server decodes
+// its image and launch times from the listing, but doesn't encode them.
+type inventoryServer struct {
+	servers.Server
+}
+
+func (s inventoryServer) MarshalJSON() ([]byte, error) {
+	var image any = "" // Servers booted from a volume have no image
+	if s.Image != nil {
+		image = s.Image
+	}
+	return json.Marshal(struct {
+		servers.Server
+		Image        any     `json:"image"`
+		LaunchedAt   *string `json:"OS-SRV-USG:launched_at"`
+		TerminatedAt *string `json:"OS-SRV-USG:terminated_at"`
+	}{s.Server, image, novaTime(s.LaunchedAt), novaTime(s.TerminatedAt)})
+}
+
+// novaTime formats t as the usage times of Nova, nil when zero.
+func novaTime(t time.Time) *string {
+	if t.IsZero() {
+		return nil
+	}
+	formatted := t.UTC().Format(gophercloud.RFC3339MilliNoZ)
+	return &formatted
+}
+
+// LoadInventory reads the servers saved at path by SaveInventory, or listed by
+// GET /servers/detail.
+func LoadInventory(path string) ([]servers.Server, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read inventory %s: %w", path, err)
+	}
+	var inv inventoryFile
+	if err := json.Unmarshal(data, &inv); err != nil {
+		return nil, fmt.Errorf("failed to parse inventory %s: %w", path, err)
+	}
+	serverList := make([]servers.Server, len(inv.Servers))
+	for i, server := range inv.Servers {
+		serverList[i] = server.Server
+	}
+	return serverList, nil
+}
+
+// SaveInventory writes the servers at path, to be simulated later.
+func SaveInventory(path string, serverList []servers.Server) error {
+	inv := inventoryFile{Servers: make([]inventoryServer, len(serverList))}
+	for i, server := range serverList {
+		inv.Servers[i] = inventoryServer{server}
+	}
+	data, err := json.MarshalIndent(inv, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode inventory: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write inventory %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package openstack
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+)
+
+func TestInventoryRoundTrip(t *testing.T) {
+	launched := time.Date(2026, 10, 1, 12, 30, 15, 123000000, time.UTC)
+	serverList := []servers.Server{
+		{
+			ID:         "1",
+			Name:       "vm",
+			TenantID:   "project",
+			Status:     "SHELVED_OFFLOADED",
+			Created:    time.Date(2026, 10, 1, 12, 30, 0, 0, time.UTC),
+			Image:      map[string]any{"id": "image-id"},
+			Flavor:     map[string]any{"original_name": "m1.small", "vcpus": float64(2), "ram": float64(4096)},
+			Metadata:   map[string]string{"sleep_zone": "ist", "vmsaver_action": "shelve"},
+			Tags:       &[]string{"vm-saver", "env=dev"},
+			LaunchedAt: launched,
+		},
+		// Booted from a volume
+		{ID: "2", Name: "volume-vm", Status: "ACTIVE", Metadata: map[string]string{}},
+	}
+
+	path := filepath.Join(t.TempDir(), "inventory.json")
+	if err := SaveInventory(path, serverList); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadInventory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != len(serverList) {
+		t.Fatalf("loaded %d servers, want %d", len(loaded), len(serverList))
+	}
+
+	got, want := loaded[0], serverList[0]
+	if image, _ := got.Image["id"].(string); image != "image-id" {
+		t.Errorf("Image = %v, want the image-id image", got.Image)
+	}
+	if !reflect.DeepEqual(got.Flavor, want.Flavor) {
+		t.Errorf("Flavor = %v, want %v", got.Flavor, want.Flavor)
+	}
+	if !reflect.DeepEqual(got.Metadata, want.Metadata) {
+		t.Errorf("Metadata = %v, want %v", got.Metadata, want.Metadata)
+	}
+	if got.Tags == nil || !reflect.DeepEqual(*got.Tags, *want.Tags) {
+		t.Errorf("Tags = %v, want %v", got.Tags, *want.Tags)
+	}
+	if got.TenantID != want.TenantID || got.Status != want.Status || !got.Created.Equal(want.Created) {
+		t.Errorf("server = %s %s %s, want %s %s %s", got.TenantID, got.Status, got.Created, want.TenantID, want.Status, want.Created)
+	}
+	if !got.LaunchedAt.Equal(launched) || !got.TerminatedAt.IsZero() {
+		t.Errorf("LaunchedAt, TerminatedAt = %s, %s, want %s and zero", got.LaunchedAt, got.TerminatedAt, launched)
+	}
+	if loaded[1].Image != nil {
+		t.Errorf("Image = %v, want none", loaded[1].Image)
+	}
+}
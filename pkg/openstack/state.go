@@ -0,0 +1,112 @@
+package openstack
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/platform9/pcd-vm-saver/pkg/clock"
+	"github.com/platform9/pcd-vm-saver/pkg/util"
+	"go.uber.org/zap"
+)
+
+// VMState is the lifecycle state of a VM managed by pcd-vm-saver, persisted in
+// the StateFilter metadata key along with the time of the last transition.
+//
+// Nova rejects metadata updates on shelved servers, so a shelved VM keeps the
+// sleeping state until it is awakened. EffectiveState combines the persisted
+// state with the Nova status to account for that.
+type VMState string
+
+const (
+	StateAwake    VMState = "awake"
+	StateSleeping VMState = "sleeping"
+	StateAsleep   VMState = "asleep"
+	StateWaking   VMState = "waking"
+	StateFailed   VMState = "failed"
+)
+
+// Allowed transitions, failed VMs can be retried in both directions.
+var stateTransitions = map[VMState][]VMState{
+	StateAwake:    {StateSleeping},
+	StateSleeping: {StateAsleep, StateWaking, StateAwake, StateFailed},
+	StateAsleep:   {StateWaking, StateAwake, StateFailed},
+	StateWaking:   {StateAwake, StateFailed},
+	StateFailed:   {StateSleeping, StateWaking, StateAwake},
+}
+
+// Nova statuses of a server once shelved or suspended. SHELVED servers are
+// offloaded after shelved_offload_time, or never when it is negative.
+var asleepStatuses = []string{"SHELVED_OFFLOADED", "SHELVED", "SUSPENDED"}
+
+// Nova statuses in which the server metadata can be updated.
+var metadataWritableStatuses = []string{"ACTIVE", "SUSPENDED", "PAUSED", "SHUTOFF"}
+
+// StoredState returns the state persisted in the server metadata, awake when
+// pcd-vm-saver never managed the server.
+func StoredState(metadata map[string]string) VMState {
+	if state, ok := metadata[util.StateFilter]; ok {
+		return VMState(state)
+	}
+	return StateAwake
+}
+
+// EffectiveState returns the current state of the server, derived from the
+// persisted state and the Nova status.
+func EffectiveState(server servers.Server) VMState {
+	stored := StoredState(server.Metadata)
+	if server.TaskState != "" {
+		return stored
+	}
+	switch {
+	case stored == StateSleeping && slices.Contains(asleepStatuses, server.Status):
+		return StateAsleep
+	case (stored == StateSleeping || stored == StateWaking || stored == StateAsleep) && server.Status == "ERROR":
+		return StateFailed
+	case stored == StateAsleep && server.Status == "ACTIVE":
+		// Woken up behind our back
+		return StateAwake
+	}
+	return stored
+}
+
+func canTransition(from, to VMState) bool {
+	return from == to || slices.Contains(stateTransitions[from], to)
+}
+
+// stateMetadata returns the metadata keys recording a transition to state.
+func stateMetadata(state VMState, now time.Time) map[string]string {
+	return map[string]string{
+		util.StateFilter:      string(state),
+		util.StateSinceFilter: now.Format(time.RFC3339),
+	}
+}
+
+// setState persists the transition of the server from one state to another.
+// Nothing is written when Nova rejects metadata updates in the current status,
+// EffectiveState then derives the state from the status.
+func (c *Cloud) setState(ctx context.Context, clk clock.Clock, id, status string, from, to VMState) error {
+	if !canTransition(from, to) {
+		return fmt.Errorf("invalid state transition of server %s from %s to %s", id, from, to)
+	}
+	if !slices.Contains(metadataWritableStatuses, status) {
+		zap.S().Debugf("Not persisting state %s of server %s in %s status", to, id, status)
+		return nil
+	}
+
+	updateOpts := servers.MetadataOpts{}
+	for key, value := range stateMetadata(to, clk.Now()) {
+		updateOpts[key] = value
+	}
+	_, err := retry(ctx, clk, DefaultRetryPolicy, fmt.Sprintf("set state of %s to %s", id, to), func() error {
+		_, err := servers.UpdateMetadata(ctx, c.compute, id, updateOpts).Extract()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to persist state %s of server %s: %w", to, id, err)
+	}
+	zap.S().Infof("Server %s moved from %s to %s", id, from, to)
+	return nil
+}
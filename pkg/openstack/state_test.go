@@ -0,0 +1,34 @@
+package openstack
+
+import (
+	"testing"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+)
+
+func TestEffectiveState(t *testing.T) {
+	tests := []struct {
+		stored string
+		status string
+		task   string
+		want   VMState
+	}{
+		{"", "ACTIVE", "", StateAwake},
+		{"sleeping", "ACTIVE", "", StateSleeping},
+		{"sleeping", "SHELVED_OFFLOADED", "", StateAsleep},
+		{"sleeping", "SHELVED", "", StateAsleep},
+		{"sleeping", "SHELVED", "shelving_offloading", StateSleeping},
+		{"sleeping", "SUSPENDED", "", StateAsleep},
+		{"waking", "ERROR", "", StateFailed},
+		{"asleep", "ACTIVE", "", StateAwake},
+	}
+	for _, tt := range tests {
+		server := servers.Server{Status: tt.status, TaskState: tt.task, Metadata: map[string]string{}}
+		if tt.stored != "" {
+			server.Metadata["vmsaver_state"] = tt.stored
+		}
+		if got := EffectiveState(server); got != tt.want {
+			t.Errorf("EffectiveState(%q, %s, task %q) = %s, want %s", tt.stored, tt.status, tt.task, got, tt.want)
+		}
+	}
+}
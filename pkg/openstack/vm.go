@@ -2,13 +2,15 @@ package openstack
 
 import (
 	"context"
-	"os"
+	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/gophercloud/gophercloud/v2"
-	"github.com/gophercloud/gophercloud/v2/openstack"
 	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/quotasets"
 	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/platform9/pcd-vm-saver/pkg/clock"
+	"github.com/platform9/pcd-vm-saver/pkg/result"
 	"github.com/platform9/pcd-vm-saver/pkg/util"
 	"go.uber.org/zap"
 )
@@ -16,23 +18,45 @@ import (
 type serverSleepInfo struct {
 	Name        string
 	ID          string
+	ProjectID   string
+	Status      string
+	Policy      string // Policy deciding the sleep, and where it comes from
+	Reason      string // Why the policy decided the sleep
 	SuspendMode bool
 	AwakeTime   time.Time
+	Metadata    map[string]string // As evaluated, the server is left alone if it changed since
+	OldMetadata map[string]string // Metadata of the server before sleep, restored if the sleep fails
 	NewMetadata map[string]string // Metadata to be updated on the server
+	// NewMetadata was already written by an interrupted run, only the sleep
+	// action remains to be done.
+	MetadataSet bool
+	// Lock the server once asleep
+	Lock bool
 }
 
 type serverAwakeInfo struct {
-	Name        string
-	ID          string
-	SuspendMode bool
-	NewMetadata map[string]string // Metadata to be updated on the server
+	Name             string
+	ID               string
+	ProjectID        string
+	Status           string
+	AvailabilityZone string
+	State            VMState
+	Metadata         map[string]string // As evaluated, the server is left alone if it changed since
+	SuspendMode      bool
+	// The server was locked by pcd-vm-saver and must be unlocked first
+	Unlock bool
+	// The server was SHUTOFF before sleep, it is powered off again once awake
+	PowerOff bool
+	// The server is already ACTIVE, e.g. an earlier cleanup failed, only its
+	// schedule metadata needs to be cleaned up.
+	AlreadyActive bool
 }
 
-type SleepState struct {
-	Name        string
-	ID          string
-	SleepStatus string
-}
+// Maximum time to wait for a VM to settle after it was put to sleep or awakened.
+const (
+	sleepWaitTimeout = 10 * time.Minute
+	awakeWaitTimeout = 10 * time.Minute
+)
 
 type Metrics struct {
 	VCPUsInUse int
@@ -41,269 +65,310 @@ type Metrics struct {
 	RAMLimit   int
 }
 
-func FetchVMsToSleep(ctx context.Context) []serverSleepInfo {
+// FetchVMsToSleep returns the servers that need to sleep now, along with the
+// servers that have a schedule but were skipped or need attention.
+func (c *Cloud) FetchVMsToSleep(ctx context.Context, clk clock.Clock) ([]serverSleepInfo, []result.VMResult, error) {
 
 	var sleepVMs []serverSleepInfo
+	var skipped []result.VMResult
 
-	// TODO: Add this to main init
-	// OpenStack authentication credentials
-	opts := gophercloud.AuthOptions{
-		IdentityEndpoint: os.Getenv("OS_AUTH_URL"),
-		Username:         os.Getenv("OS_USERNAME"),
-		Password:         os.Getenv("OS_PASSWORD"),
-		DomainName:       os.Getenv("OS_USER_DOMAIN_NAME"),
-		// Either of Domain Name or Domain ID is only required not both.
-		TenantName: os.Getenv("OS_PROJECT_NAME"),
-		TenantID:   os.Getenv("OS_PROJECT_ID"),
-	}
-
-	// Authenticate
-	provider, err := openstack.AuthenticatedClient(ctx, opts)
+	serverList, err := c.inventory.Servers(ctx, clk, sleepScanStatuses...)
 	if err != nil {
-		zap.S().Errorf("Authentication failed: %v", err)
-		return sleepVMs
+		return nil, nil, err
 	}
 
-	// Create compute client
-	client, err := openstack.NewComputeV2(provider, gophercloud.EndpointOpts{
-		Region: os.Getenv("OS_REGION_NAME"),
-	})
+	zap.S().Infof("Total servers in inventory: %d", len(serverList))
 
+	groups, err := c.serverGroups(ctx)
 	if err != nil {
-		zap.S().Errorf("Failed to create compute client: %v", err)
-		return sleepVMs
+		return nil, nil, err
 	}
 
-	// Fetch all servers
-	listOpts := servers.ListOpts{
-		// TODO: P0 we are only considering active servers
-		Status: "ACTIVE", // Only fetch active servers
+	// Filter servers by metadata
+	now := clk.Now()
+	for _, server := range serverList {
+		info, skip, ok := c.evaluateSleep(ctx, server, now, groups)
+		if ok {
+			zap.S().Infof("Server %s with ID %s is eligible for sleep based on %s: %s", server.Name, server.ID, info.Policy, info.Reason)
+			sleepVMs = append(sleepVMs, info)
+		} else if res := c.reportSkip(server, skip); res != nil {
+			skipped = append(skipped, *res)
+		}
 	}
+	return sleepVMs, skipped, nil
+}
 
-	allPages, err := servers.List(client, listOpts).AllPages(ctx)
-	if err != nil {
-		zap.S().Errorf("Failed to list servers: %v", err)
-		return sleepVMs
+// evaluateSleep decides whether the server needs to sleep now, as the sleep run
+// does. When it does not, skip tells why. groups are the server groups of each
+// server.
+func (c *Cloud) evaluateSleep(ctx context.Context, server servers.Server, now time.Time, groups map[string][]string) (serverSleepInfo, skip, bool) {
+	leaveAlone := func(reason string) (serverSleepInfo, skip, bool) {
+		return serverSleepInfo{}, skip{skipLeftAlone, reason}, false
 	}
 
-	// Extract server list
-	serverList, err := servers.ExtractServers(allPages)
-	if err != nil {
-		zap.S().Errorf("Failed to extract servers: %v", err)
-		return sleepVMs
+	switch {
+	case server.Status == "ERROR":
+		if !hasSchedule(server, now, c.policies) {
+			return serverSleepInfo{}, skip{}, false
+		}
+		reason := "server is in ERROR state"
+		if server.Fault.Message != "" {
+			reason += ": " + server.Fault.Message
+		}
+		return serverSleepInfo{}, skip{skipNeedsAttention, reason}, false
+	case server.Status == "SHUTOFF" && c.shelveShutoff:
+	case server.Status != "ACTIVE":
+		return serverSleepInfo{}, skip{}, false
 	}
 
-	zap.S().Infof("Total servers fetched:", len(serverList))
-
-	// Filter servers by metadata
-	for _, server := range serverList {
-
-		// Only check those servers which have metadata
-		if len(server.Metadata) > 0 {
-			zap.S().Debugf("Checking server:", server.Name, "with ID:", server.ID, "and Metadata:", server.Metadata)
-
-			// Check if OverrideSleepFilter is set to true
-			if overrideSleepVal, exists := server.Metadata[util.OverrideSleepFilter]; exists && overrideSleepVal == "true" {
-				// If OverrideSleepFilter is set to true, skip this server
-				zap.S().Infof("Skipping server %s with ID %s due to OverrideSleepFilter", server.Name, server.ID)
-				continue
-			}
-
-			// check if metadata contains SleepModeFilter
-			var suspendMode bool
-			if sleepMode, exists := server.Metadata[util.SleepModeFilter]; exists && sleepMode == "true" {
-				// If SleepModeFilter is set to ram_preserve, we need to consider it suspend instead of shelve
-				suspendMode = true
-			}
-
-			// Check for DefaultSleepFilter or CustomSleepFilter
-
-			// Case 1: Default Sleep Filter i.e Zone based
-			if serverVal, exists := server.Metadata[util.DefaultSleepFilter]; exists && (serverVal == util.IndiaSleepVal || serverVal == util.USSleepVal) {
-
-				// Verify the VM needs to seelp now its time i.e 10-10:30 PM
-				currentTime := time.Now()
-
-				var sleepTime, awakeTime time.Time
-
-				if serverVal == util.IndiaSleepVal {
-					// For India, sleep at 8 PM and awake at 8:30 AM
-					// Change this for testing
-					sleepTime = time.Date(currentTime.Year(), currentTime.Month(), currentTime.Day(), 20, 0, 0, 0, currentTime.Location())
-					awakeTime = time.Date(currentTime.Year(), currentTime.Month(), currentTime.Day()+1, 8, 30, 0, 0, currentTime.Location())
-				}
-
-				if serverVal == util.USSleepVal {
-					// For US, sleep at 8 AM and awake at 8:30 PM
-					sleepTime = time.Date(currentTime.Year(), currentTime.Month(), currentTime.Day(), 8, 0, 0, 0, currentTime.Location())
-					awakeTime = time.Date(currentTime.Year(), currentTime.Month(), currentTime.Day(), 20, 30, 0, 0, currentTime.Location())
-				}
+	info, s, ok := sleepCandidate(server, now, c.policies)
+	if !ok {
+		return serverSleepInfo{}, s, false
+	}
+	if server.TaskState != "" {
+		return leaveAlone(fmt.Sprintf("task %s in progress", server.TaskState))
+	}
+	if reason := c.exclusionReason(server, now, groups); reason != "" {
+		return leaveAlone(reason)
+	}
+	// Don't fight a user who woke the server up during its window
+	if s := c.checkManualWake(ctx, server, now); s.kind != 0 {
+		return serverSleepInfo{}, s, false
+	}
+	if c.lock {
+		if isLocked(server) {
+			return leaveAlone("server is locked by someone else")
+		}
+		info.Lock = true
+		info.NewMetadata[util.LockedFilter] = "true"
+	}
+	info.ProjectID = c.projectOf(server)
+	return info, skip{}, true
+}
 
-				// Check if current time is between sleep and awake time
-				if currentTime.After(sleepTime) && currentTime.Before(awakeTime) {
+// reportSkip logs why the server is not slept or awakened by a run, and returns
+// the result reporting it, nil when the skip is not reported.
+func (c *Cloud) reportSkip(server servers.Server, s skip) *result.VMResult {
+	res := c.skippedResult(server, s.reason)
+	switch s.kind {
+	case skipNotDue:
+		zap.S().Debugf("Server %s with ID %s is %s", server.Name, server.ID, s.reason)
+		return nil
+	case skipLeftAlone:
+		zap.S().Infof("Skipping server %s with ID %s: %s", server.Name, server.ID, s.reason)
+	case skipFailed:
+		zap.S().Errorf("Skipping server %s with ID %s: %s", server.Name, server.ID, s.reason)
+	case skipNeedsAttention:
+		zap.S().Warnf("Server %s with ID %s needs attention: %s", server.Name, server.ID, s.reason)
+		res.Outcome = result.NeedsAttention
+	default:
+		return nil
+	}
+	return &res
+}
 
-					// add AwakeTime to existing metadata
-					newMetadata := make(map[string]string)
-					if server.Metadata != nil {
-						newMetadata = server.Metadata
-					}
+// SleepVMs shelves/suspends the servers concurrently and waits for each of them
+// to reach SHELVED_OFFLOADED/SUSPENDED state. Clouds keeping shelved servers
+// on their host for a while (shelved_offload_time) leave them SHELVED.
+func (c *Cloud) SleepVMs(ctx context.Context, clk clock.Clock, serversInfo []serverSleepInfo) []result.VMResult {
+	results := make([]result.VMResult, len(serversInfo))
+	for i, server := range serversInfo {
+		results[i] = c.vmResult(server.Name, server.ID, server.ProjectID, server.Status)
+		results[i].Action = "shelve"
+		if server.SuspendMode {
+			results[i].Action = "suspend"
+		}
+	}
+	if c.DryRun {
+		for i, server := range serversInfo {
+			results[i].Outcome, results[i].Reason = result.Planned, "asleep until "+server.AwakeTime.Format(time.RFC3339)
+		}
+		return results
+	}
+	err := forEach(ctx, c.Workers, len(serversInfo), func(i int) {
+		server := serversInfo[i]
+		start := clk.Now()
+		res := &results[i]
+		defer func() { res.Duration = clk.Now().Sub(start) }()
+
+		release, ok := c.claim(ctx, clk, server.ID, server.Status, server.Metadata, res)
+		if !ok {
+			return
+		}
+		defer release()
 
-					newMetadata[util.AwakeTimeFilter] = awakeTime.Format(time.RFC3339)
+		if err := c.sleepVM(ctx, clk, server, res); err != nil {
+			res.Outcome, res.Reason = result.Failed, err.Error()
+			return
+		}
 
-					sleepVMs = append(sleepVMs, serverSleepInfo{
-						Name:        server.Name,
-						ID:          server.ID,
-						SuspendMode: suspendMode,
-						AwakeTime:   awakeTime,
-						NewMetadata: newMetadata,
-					})
-				}
+		sleepState, err := c.WaitForStatus(ctx, clk, server.ID,
+			sleptStatuses[res.Action], []string{"ERROR"}, sleepWaitTimeout)
+		if sleepState != nil {
+			res.NewStatus = sleepState.Status
+		}
+		if err != nil {
+			zap.S().Errorf("VM %s (ID: %s) did not reach %v state: %v", server.Name, server.ID, sleptStatuses[res.Action], err)
+			res.Outcome, res.Reason = result.Failed, err.Error()
+			c.markFailed(ctx, clk, sleepState)
+			return
+		}
 
-				// Case 2: Custom Sleep Filter i.e Zone based
-			} else if customSleepVal, exists := server.Metadata[util.CustomSleepFilter]; exists {
+		// Shelved servers keep the sleeping state, their metadata can't be updated
+		if err := c.setState(ctx, clk, server.ID, sleepState.Status, EffectiveState(*sleepState), StateAsleep); err != nil {
+			zap.S().Errorf("VM %s (ID: %s) is asleep but its state was not persisted: %v", server.Name, server.ID, err)
+		}
 
-				customSleepHours, err := time.ParseDuration(customSleepVal + "h")
-				if err != nil {
-					zap.S().Errorf("Invalid custom sleep value for server %s with ID %s: %v", server.Name, server.ID, err)
-					continue
-				}
-				currentTime := time.Now()
-				creationTime := server.Created
-
-				// Difference
-				elapsed := currentTime.Sub(creationTime)
-
-				if elapsed >= customSleepHours && int(elapsed/customSleepHours) >= 0 {
-
-					awakeTime := currentTime.Add(customSleepHours)
-					// add AwakeTime to existing metadata
-					newMetadata := make(map[string]string)
-					if server.Metadata != nil {
-						newMetadata = server.Metadata
-					}
-
-					newMetadata[util.AwakeTimeFilter] = awakeTime.Format(time.RFC3339)
-
-					// If the elapsed time is a multiple of custom sleep hours, we can consider it for sleep
-					zap.S().Infof("Server %s with ID %s is eligible for sleep based on custom sleep filter", server.Name, server.ID)
-					sleepVMs = append(sleepVMs, serverSleepInfo{
-						Name:        server.Name,
-						ID:          server.ID,
-						SuspendMode: false,
-						AwakeTime:   awakeTime,
-						NewMetadata: newMetadata,
-					})
-
-				} else {
-					// If no default or custom sleep filter, skip this server
-					zap.S().Infof("Server %s with ID %s is not eligible for sleep based on custom/default sleep filter", server.Name, server.ID)
-					continue
-				}
+		// The state must be persisted first, metadata can't be updated once locked
+		if server.Lock {
+			if err := c.lockVM(ctx, clk, server, res); err != nil {
+				res.Outcome, res.Reason = result.Failed, "asleep but lock failed: "+err.Error()
+				return
 			}
 		}
-	}
-	return sleepVMs
+		res.Outcome = result.Acted
+	})
+	notRun(results, err)
+	return results
 }
 
-func SleepVMs(ctx context.Context, serversInfo []serverSleepInfo) {
-	// TODO: Add this to main init
-	// OpenStack authentication credentials
-	opts := gophercloud.AuthOptions{
-		IdentityEndpoint: os.Getenv("OS_AUTH_URL"),
-		Username:         os.Getenv("OS_USERNAME"),
-		Password:         os.Getenv("OS_PASSWORD"),
-		DomainName:       os.Getenv("OS_USER_DOMAIN_NAME"),
-		// Either of Domain Name or Domain ID is only required not both.
-		TenantName: os.Getenv("OS_PROJECT_NAME"),
-		TenantID:   os.Getenv("OS_PROJECT_ID"),
-	}
-
-	// Authenticate
-	provider, err := openstack.AuthenticatedClient(ctx, opts)
-	if err != nil {
-		zap.S().Errorf("Authentication failed: %v", err)
-		return
+// claim reserves the server for the caller before it is acted upon, so that
+// the sleep and awake jobs never act on it at the same time, and rechecks it.
+// When it is held by another job, changed since it was evaluated or could not
+// be fetched, res reports why and ok is false. Otherwise release must be called
+// once done, the server is then re-fetched by the next inventory refresh.
+func (c *Cloud) claim(ctx context.Context, clk clock.Clock, id, status string, metadata map[string]string, res *result.VMResult) (release func(), ok bool) {
+	c.inFlightMu.Lock()
+	if c.inFlight[id] {
+		c.inFlightMu.Unlock()
+		res.Outcome, res.Reason = result.Skipped, "server is being acted upon by another run"
+		return nil, false
+	}
+	c.inFlight[id] = true
+	c.inFlightMu.Unlock()
+
+	release = func() {
+		c.inventory.invalidate(id)
+		c.inFlightMu.Lock()
+		delete(c.inFlight, id)
+		c.inFlightMu.Unlock()
+	}
+	skip, err := c.recheck(ctx, clk, id, status, metadata)
+	switch {
+	case err != nil:
+		res.Outcome, res.Reason = result.Failed, err.Error()
+	case skip != "":
+		res.Outcome, res.Reason = result.Skipped, skip
+	default:
+		return release, true
 	}
+	release()
+	return nil, false
+}
 
-	// Create compute client
-	client, err := openstack.NewComputeV2(provider, gophercloud.EndpointOpts{
-		Region: os.Getenv("OS_REGION_NAME"),
-	})
-	if err != nil {
-		zap.S().Errorf("Failed to create compute client: %v", err)
-		return
+// notRun marks the VMs a cancelled run did not get to as failed.
+func notRun(results []result.VMResult, err error) {
+	for i := range results {
+		if results[i].Outcome == "" {
+			results[i].Outcome, results[i].Reason = result.Failed, "not run: "+err.Error()
+		}
 	}
+}
 
-	// TODO: Make them parallel
-	for _, server := range serversInfo {
-		zap.S().Infof("Processing server %s with ID %s for sleep", server.Name, server.ID)
-		// NOTE: We need to update the metadata before the VM is suspended or shelved. We can't update it later.
+func (c *Cloud) sleepVM(ctx context.Context, clk clock.Clock, server serverSleepInfo, res *result.VMResult) error {
+	zap.S().Infof("Processing server %s with ID %s for sleep", server.Name, server.ID)
+	// NOTE: We need to update the metadata before the VM is suspended or shelved. We can't update it later.
 
-		// Update Server metadata with AwakeTime
+	// Update Server metadata with AwakeTime and the sleeping state
+	if !server.MetadataSet {
 		updateOpts := servers.MetadataOpts{}
 		for key, value := range server.NewMetadata {
 			updateOpts[key] = value
 		}
 
-		_, err := servers.UpdateMetadata(ctx, client, server.ID, updateOpts).Extract()
+		attempts, err := retry(ctx, clk, DefaultRetryPolicy, "update metadata of "+server.Name, func() error {
+			_, err := servers.UpdateMetadata(ctx, c.compute, server.ID, updateOpts).Extract()
+			return err
+		})
+		res.Attempts += attempts
 		if err != nil {
 			zap.S().Errorf("Failed to update metadata for server %s: %v", server.Name, err)
-			//TODO: Add retry logic
-			continue
+			return err
 		}
+	}
 
-		if server.SuspendMode {
-			susRes := servers.Suspend(ctx, client, server.ID)
-			if susRes.Err != nil {
-				zap.S().Errorf("Failed to suspend server %s: %v", server.Name, susRes.Err)
-				continue
-			}
-		} else {
-			shlRes := servers.Shelve(ctx, client, server.ID)
-			if shlRes.Err != nil {
-				zap.S().Errorf("Failed to shelve server %s: %v", server.Name, shlRes.Err)
-				continue
-			}
+	if server.SuspendMode {
+		attempts, err := retry(ctx, clk, DefaultRetryPolicy, "suspend "+server.Name, func() error {
+			return servers.Suspend(ctx, c.compute, server.ID).Err
+		})
+		res.Attempts += attempts
+		if err != nil {
+			zap.S().Errorf("Failed to suspend server %s: %v", server.Name, err)
+			return c.rollbackSleepMetadata(ctx, clk, server, err)
+		}
+	} else {
+		attempts, err := retry(ctx, clk, DefaultRetryPolicy, "shelve "+server.Name, func() error {
+			return servers.Shelve(ctx, c.compute, server.ID).Err
+		})
+		res.Attempts += attempts
+		if err != nil {
+			zap.S().Errorf("Failed to shelve server %s: %v", server.Name, err)
+			return c.rollbackSleepMetadata(ctx, clk, server, err)
 		}
-
-		// So for failed suspend and shelve by metadata is updated, we can handle that case in Awake. Awake if its not Active
-		zap.S().Infof("Server %s with ID %s is scheduled to sleep until %s", server.Name, server.ID, server.AwakeTime)
 	}
-}
 
-func Quotas(ctx context.Context) Metrics {
+	zap.S().Infof("Server %s with ID %s is scheduled to sleep until %s", server.Name, server.ID, server.AwakeTime)
+	return nil
+}
 
-	var metrics Metrics
-	// TODO: Add this to main init
-	// OpenStack authentication credentials
-	opts := gophercloud.AuthOptions{
-		IdentityEndpoint: os.Getenv("OS_AUTH_URL"),
-		Username:         os.Getenv("OS_USERNAME"),
-		Password:         os.Getenv("OS_PASSWORD"),
-		DomainName:       os.Getenv("OS_USER_DOMAIN_NAME"),
-		// Either of Domain Name or Domain ID is only required not both.
-		TenantName: os.Getenv("OS_PROJECT_NAME"),
-		TenantID:   os.Getenv("OS_PROJECT_ID"),
-	}
-
-	// Authenticate
-	provider, err := openstack.AuthenticatedClient(ctx, opts)
-	if err != nil {
-		zap.S().Errorf("Authentication failed: %v", err)
+// rollbackSleepMetadata restores the metadata keys changed by sleepVM after the
+// sleep action failed, so the server does not carry a schedule for a sleep that
+// never happened. actionErr is returned, annotated if the rollback failed too.
+func (c *Cloud) rollbackSleepMetadata(ctx context.Context, clk clock.Clock, server serverSleepInfo, actionErr error) error {
+	restoreOpts := servers.MetadataOpts{}
+	var deleteKeys []string
+	for key, value := range server.NewMetadata {
+		oldValue, existed := server.OldMetadata[key]
+		switch {
+		case !existed:
+			deleteKeys = append(deleteKeys, key)
+		case oldValue != value:
+			restoreOpts[key] = oldValue
+		}
 	}
 
-	computeClient, err := openstack.NewComputeV2(provider, gophercloud.EndpointOpts{
-		Region: os.Getenv("OS_REGION_NAME"),
+	_, err := retry(ctx, clk, DefaultRetryPolicy, "rollback metadata of "+server.Name, func() error {
+		if len(restoreOpts) > 0 {
+			if _, err := servers.UpdateMetadata(ctx, c.compute, server.ID, restoreOpts).Extract(); err != nil {
+				return err
+			}
+		}
+		for len(deleteKeys) > 0 {
+			err := servers.DeleteMetadatum(ctx, c.compute, server.ID, deleteKeys[0]).ExtractErr()
+			// A key already gone is what we want.
+			if err != nil && !gophercloud.ResponseCodeIs(err, http.StatusNotFound) {
+				return err
+			}
+			deleteKeys = deleteKeys[1:]
+		}
+		return nil
 	})
 	if err != nil {
-		zap.S().Errorf("Failed to create compute client: %v", err)
-		return metrics
+		zap.S().Errorf("Failed to rollback metadata of server %s after failed sleep: %v", server.Name, err)
+		return fmt.Errorf("%w (metadata rollback also failed: %v)", actionErr, err)
 	}
 
-	quotaDetails, err := quotasets.GetDetail(ctx, computeClient, os.Getenv("OS_PROJECT_ID")).Extract()
+	zap.S().Infof("Rolled back metadata of server %s with ID %s after failed sleep", server.Name, server.ID)
+	return actionErr
+}
+
+func (c *Cloud) Quotas(ctx context.Context, projectID string) (Metrics, error) {
+
+	var metrics Metrics
+
+	quotaDetails, err := quotasets.GetDetail(ctx, c.compute, projectID).Extract()
 	if err != nil {
-		zap.S().Errorf("Failed to get quota details: %v", err)
-		return metrics
+		return metrics, fmt.Errorf("failed to get quota details of project %s: %w", projectID, err)
 	}
 
 	// Log the quota details
@@ -318,203 +383,247 @@ func Quotas(ctx context.Context) Metrics {
 	metrics.RAMLimit = quotaDetails.RAM.Limit
 	metrics.VCPUsLimit = quotaDetails.Cores.Limit
 
-	return metrics
-}
-
-func GetVMStatus(ctx context.Context, serverId string) *servers.Server {
-	// TODO: Add this to main init
-	// OpenStack authentication credentials
-	opts := gophercloud.AuthOptions{
-		IdentityEndpoint: os.Getenv("OS_AUTH_URL"),
-		Username:         os.Getenv("OS_USERNAME"),
-		Password:         os.Getenv("OS_PASSWORD"),
-		DomainName:       os.Getenv("OS_USER_DOMAIN_NAME"),
-		// Either of Domain Name or Domain ID is only required not both.
-		TenantName: os.Getenv("OS_PROJECT_NAME"),
-		TenantID:   os.Getenv("OS_PROJECT_ID"),
-	}
-
-	// Authenticate
-	provider, err := openstack.AuthenticatedClient(ctx, opts)
-	if err != nil {
-		zap.S().Errorf("Authentication failed: %v", err)
-	}
-
-	// Create compute client
-	client, err := openstack.NewComputeV2(provider, gophercloud.EndpointOpts{
-		Region: os.Getenv("OS_REGION_NAME"),
-	})
-	if err != nil {
-		zap.S().Errorf("Failed to create compute client: %v", err)
-	}
-
-	// GET server list
-	server, err := servers.Get(ctx, client, serverId).Extract()
-	if err != nil {
-		zap.S().Errorf("Failed to get server %s: %v", serverId, err)
-		return nil
-	}
-
-	return server
+	return metrics, nil
 }
 
-func GetVMsToAwake(ctx context.Context) []serverAwakeInfo {
+// GetVMsToAwake returns the servers whose awake time has passed, along with the
+// servers that have an awake time but were skipped.
+func (c *Cloud) GetVMsToAwake(ctx context.Context, clk clock.Clock) ([]serverAwakeInfo, []result.VMResult, error) {
 
 	var awakeVMs []serverAwakeInfo
+	var skipped []result.VMResult
 
-	// TODO: Add this to main init
-	// OpenStack authentication credentials
-	opts := gophercloud.AuthOptions{
-		IdentityEndpoint: os.Getenv("OS_AUTH_URL"),
-		Username:         os.Getenv("OS_USERNAME"),
-		Password:         os.Getenv("OS_PASSWORD"),
-		DomainName:       os.Getenv("OS_USER_DOMAIN_NAME"),
-		// Either of Domain Name or Domain ID is only required not both.
-		TenantName: os.Getenv("OS_PROJECT_NAME"),
-		TenantID:   os.Getenv("OS_PROJECT_ID"),
-	}
-
-	// Authenticate
-	provider, err := openstack.AuthenticatedClient(ctx, opts)
+	// Only consider the servers that can be asleep, and the awakened ones
+	// still carrying their schedule metadata
+	serverList, err := c.inventory.Servers(ctx, clk, append([]string{"ACTIVE"}, awakeScanStatuses...)...)
 	if err != nil {
-		zap.S().Errorf("Authentication failed: %v", err)
-		return awakeVMs
+		return nil, nil, err
 	}
 
-	// Create compute client
-	client, err := openstack.NewComputeV2(provider, gophercloud.EndpointOpts{
-		Region: os.Getenv("OS_REGION_NAME"),
-	})
-
-	if err != nil {
-		zap.S().Errorf("Failed to create compute client: %v", err)
-		return awakeVMs
+	now := clk.Now()
+	stranded := 0
+	for _, listed := range serverList {
+		server, adopted := c.adoptLegacy(listed, now)
+		info, skip, ok := awakeCandidate(server, now)
+		if _, legacy := legacySleep(listed); legacy && !adopted {
+			stranded++
+			if skip.kind == skipLeftAlone {
+				skip.reason = "put to sleep by a previous release, not adopted"
+			}
+		}
+		if ok {
+			if adopted {
+				zap.S().Infof("Adopting server %s with ID %s, put to sleep by a previous release", server.Name, server.ID)
+			}
+			info.ProjectID = c.projectOf(server)
+			info.Metadata = listed.Metadata
+			awakeVMs = append(awakeVMs, info)
+		} else if res := c.reportSkip(server, skip); res != nil {
+			skipped = append(skipped, *res)
+		}
 	}
+	c.warnStranded(stranded)
+	return awakeVMs, skipped, nil
+}
 
-	// Fetch all servers
-	listOpts := servers.ListOpts{}
-
-	allPages, err := servers.List(client, listOpts).AllPages(ctx)
-	if err != nil {
-		zap.S().Errorf("Failed to list servers: %v", err)
-		return awakeVMs
+// AwakeVMs unshelves/resumes the servers concurrently, waits for each of them
+// to become ACTIVE and then cleans up their schedule metadata.
+func (c *Cloud) AwakeVMs(ctx context.Context, clk clock.Clock, awakeVMsInfo []serverAwakeInfo) []result.VMResult {
+	results := make([]result.VMResult, len(awakeVMsInfo))
+	for i, server := range awakeVMsInfo {
+		results[i] = c.vmResult(server.Name, server.ID, server.ProjectID, server.Status)
+		results[i].Action = "unshelve"
+		if server.SuspendMode {
+			results[i].Action = "resume"
+		}
 	}
-
-	// Extract server list
-	serverList, err := servers.ExtractServers(allPages)
-	if err != nil {
-		zap.S().Errorf("Failed to extract servers: %v", err)
-		return awakeVMs
+	if c.DryRun {
+		for i, server := range awakeVMsInfo {
+			results[i].Outcome, results[i].Reason = result.Planned, "awake time has passed"
+			if server.AlreadyActive {
+				results[i].Action = "cleanup"
+			}
+		}
+		return results
 	}
+	err := forEach(ctx, c.Workers, len(awakeVMsInfo), func(i int) {
+		server := awakeVMsInfo[i]
+		start := clk.Now()
+		res := &results[i]
+		defer func() { res.Duration = clk.Now().Sub(start) }()
+
+		release, ok := c.claim(ctx, clk, server.ID, server.Status, server.Metadata, res)
+		if !ok {
+			return
+		}
+		defer release()
 
-	for _, server := range serverList {
+		if server.Unlock {
+			if err := c.unlockVM(ctx, clk, server, res); err != nil {
+				res.Outcome, res.Reason = result.Failed, err.Error()
+				return
+			}
+		}
 
-		// Only check those servers which have metadata
-		if len(server.Metadata) > 0 {
-			// stale awake timestamp
-			if server.Status == "ACTIVE" {
-				// If the server is already active, we don't need to awake it
-				zap.S().Infof("Server %s with ID %s is already active, skipping awake", server.Name, server.ID)
-				continue
+		if server.AlreadyActive {
+			res.Action, res.NewStatus = "cleanup", server.Status
+		} else {
+			// Shelved servers can't record the waking state, EffectiveState
+			// reports them as asleep until they are ACTIVE again
+			if err := c.setState(ctx, clk, server.ID, server.Status, server.State, StateWaking); err != nil {
+				res.Outcome, res.Reason = result.Failed, err.Error()
+				return
+			}
+			if err := c.awakeVM(ctx, clk, server, res); err != nil {
+				res.Outcome, res.Reason = result.Failed, err.Error()
+				return
 			}
-			zap.S().Debugf("Checking server:", server.Name, "with ID:", server.ID, "and Metadata:", server.Metadata)
 
-			var suspendMode bool
-			if sleepMode, exists := server.Metadata[util.SleepModeFilter]; exists && sleepMode == "true" {
-				// If SleepModeFilter is set to ram_preserve, we need to consider it suspend instead of shelve
-				suspendMode = true
+			// Metadata can only be updated once the server is ACTIVE with no task in progress
+			vmStatus, err := c.WaitForStatus(ctx, clk, server.ID, []string{"ACTIVE"}, []string{"ERROR"}, awakeWaitTimeout)
+			if vmStatus != nil {
+				res.NewStatus = vmStatus.Status
+			}
+			if err != nil {
+				zap.S().Errorf("VM %s (ID: %s) did not reach ACTIVE state: %v", server.Name, server.ID, err)
+				res.Outcome, res.Reason = result.Failed, err.Error()
+				c.markFailed(ctx, clk, vmStatus)
+				return
 			}
 
-			// Check for AwakeTimeFilter
-			if awakeTimeStr, exists := server.Metadata[util.AwakeTimeFilter]; exists {
-				awakeTime, err := time.Parse(time.RFC3339, awakeTimeStr)
-				if err != nil {
-					zap.S().Errorf("Invalid AwakeTime for server %s with ID %s: %v", server.Name, server.ID, err)
-					continue
+			// Leave the server powered off, as it was before sleep
+			if server.PowerOff {
+				if err := c.powerOffVM(ctx, clk, server, res); err != nil {
+					res.Outcome, res.Reason = result.Failed, "awake but power off failed: "+err.Error()
+					return
 				}
+			}
+		}
 
-				// remove AwakeTimeFilter from metadata
-				metadata := server.Metadata
-				delete(metadata, util.AwakeTimeFilter)
-
-				currentTime := time.Now()
-				if currentTime.After(awakeTime) {
-					// If current time is after AwakeTime, we can consider it for awake
-					awakeVMs = append(awakeVMs, serverAwakeInfo{
-						Name:        server.Name,
-						ID:          server.ID,
-						SuspendMode: suspendMode,
-						NewMetadata: metadata, // remove AwakeTimeFilter from metadata
-					})
-				} else {
-					zap.S().Infof("Server %s with ID %s is not yet ready to awake, current time: %s, awake time: %s", server.Name, server.ID, currentTime.Format(time.RFC3339), awakeTime.Format(time.RFC3339))
-				}
+		// The server is awake, a failed cleanup is retried by the next awake scan
+		if err := c.cleanupAwakeMetadata(ctx, clk, server, res); err != nil {
+			res.Outcome, res.Reason = result.Failed, "awake but metadata cleanup failed: "+err.Error()
+			return
+		}
+		res.Outcome = result.Acted
+	})
+	notRun(results, err)
+	return results
+}
+
+// Metadata keys recording the sleep of a server, removed once it is awake or
+// its interrupted sleep is given up.
+var scheduleKeys = []string{util.AwakeTimeFilter, util.SleptAtFilter, util.SleptActionFilter, util.LockedFilter, util.PriorStatusFilter}
+
+// cleanupAwakeMetadata removes the schedule keys of an awakened server,
+// archives the awake time as LastAwakeFilter and moves it to the awake state.
+func (c *Cloud) cleanupAwakeMetadata(ctx context.Context, clk clock.Clock, server serverAwakeInfo, res *result.VMResult) error {
+	attempts, err := retry(ctx, clk, DefaultRetryPolicy, "cleanup metadata of "+server.Name, func() error {
+		now := clk.Now()
+		archiveOpts := servers.MetadataOpts{util.LastAwakeFilter: now.Format(time.RFC3339)}
+		for key, value := range stateMetadata(StateAwake, now) {
+			archiveOpts[key] = value
+		}
+		if _, err := servers.UpdateMetadata(ctx, c.compute, server.ID, archiveOpts).Extract(); err != nil {
+			return err
+		}
+		for _, key := range scheduleKeys {
+			err := servers.DeleteMetadatum(ctx, c.compute, server.ID, key).ExtractErr()
+			if err != nil && !gophercloud.ResponseCodeIs(err, http.StatusNotFound) {
+				return err
 			}
 		}
+		return nil
+	})
+	res.Attempts += attempts
+	if err != nil {
+		zap.S().Errorf("Failed to cleanup metadata of server %s: %v", server.Name, err)
+		return err
 	}
-	return awakeVMs
+	zap.S().Infof("Removed %v from server %s with ID %s", scheduleKeys, server.Name, server.ID)
+	return nil
 }
 
-func AwakeVMs(ctx context.Context, awakeVMsInfo []serverAwakeInfo) {
-	// TODO: Add this to main init
-	// OpenStack authentication credentials
-	opts := gophercloud.AuthOptions{
-		IdentityEndpoint: os.Getenv("OS_AUTH_URL"),
-		Username:         os.Getenv("OS_USERNAME"),
-		Password:         os.Getenv("OS_PASSWORD"),
-		DomainName:       os.Getenv("OS_USER_DOMAIN_NAME"),
-		// Either of Domain Name or Domain ID is only required not both.
-		TenantName: os.Getenv("OS_PROJECT_NAME"),
-		TenantID:   os.Getenv("OS_PROJECT_ID"),
-	}
-
-	// Authenticate
-	provider, err := openstack.AuthenticatedClient(ctx, opts)
+// powerOffVM stops an unshelved server that was SHUTOFF before sleep.
+func (c *Cloud) powerOffVM(ctx context.Context, clk clock.Clock, server serverAwakeInfo, res *result.VMResult) error {
+	attempts, err := retry(ctx, clk, DefaultRetryPolicy, "stop "+server.Name, func() error {
+		return servers.Stop(ctx, c.compute, server.ID).ExtractErr()
+	})
+	res.Attempts += attempts
 	if err != nil {
-		zap.S().Errorf("Authentication failed: %v", err)
-		return
+		zap.S().Errorf("Failed to stop server %s: %v", server.Name, err)
+		return err
 	}
 
-	// Create compute client
-	client, err := openstack.NewComputeV2(provider, gophercloud.EndpointOpts{
-		Region: os.Getenv("OS_REGION_NAME"),
-	})
+	vmStatus, err := c.WaitForStatus(ctx, clk, server.ID, []string{"SHUTOFF"}, []string{"ERROR"}, awakeWaitTimeout)
+	if vmStatus != nil {
+		res.NewStatus = vmStatus.Status
+	}
 	if err != nil {
-		zap.S().Errorf("Failed to create compute client: %v", err)
+		return err
+	}
+	zap.S().Infof("Server %s with ID %s is powered off again", server.Name, server.ID)
+	return nil
+}
+
+// markFailed records the failed state of a server whose sleep or awake did not
+// complete, on a best effort basis.
+func (c *Cloud) markFailed(ctx context.Context, clk clock.Clock, server *servers.Server) {
+	if server == nil {
 		return
 	}
+	if err := c.setState(ctx, clk, server.ID, server.Status, EffectiveState(*server), StateFailed); err != nil {
+		zap.S().Errorf("Failed to mark server %s as failed: %v", server.Name, err)
+	}
+}
 
-	for _, server := range awakeVMsInfo {
-		zap.S().Infof("Processing server %s with ID %s to awake", server.Name, server.ID)
+func (c *Cloud) awakeVM(ctx context.Context, clk clock.Clock, server serverAwakeInfo, res *result.VMResult) error {
+	zap.S().Infof("Processing server %s with ID %s to awake", server.Name, server.ID)
 
-		if server.SuspendMode {
-			// Resume the server if it was suspended
-			resumeRes := servers.Resume(ctx, client, server.ID)
-			if resumeRes.Err != nil {
-				zap.S().Errorf("Failed to resume server %s: %v", server.Name, resumeRes.Err)
-				continue
-			}
-		} else {
-			// Unshelve the server if it was shelved
-			unshelveRes := servers.Unshelve(ctx, client, server.ID, servers.UnshelveOpts{})
-			if unshelveRes.Err != nil {
-				zap.S().Errorf("Failed to unshelve server %s: %v", server.Name, unshelveRes.Err)
-				continue
-			}
+	if server.SuspendMode {
+		// Resume the server if it was suspended
+		attempts, err := retry(ctx, clk, DefaultRetryPolicy, "resume "+server.Name, func() error {
+			return servers.Resume(ctx, c.compute, server.ID).Err
+		})
+		res.Attempts += attempts
+		if err != nil {
+			zap.S().Errorf("Failed to resume server %s: %v", server.Name, err)
+			return err
+		}
+	} else {
+		// Unshelve the server if it was shelved, back into its availability zone when supported
+		unshelveOpts := servers.UnshelveOpts{}
+		if c.Features.UnshelveAZ && server.Status == "SHELVED_OFFLOADED" {
+			unshelveOpts.AvailabilityZone = server.AvailabilityZone
+		}
+		attempts, err := retry(ctx, clk, DefaultRetryPolicy, "unshelve "+server.Name, func() error {
+			return servers.Unshelve(ctx, c.compute, server.ID, unshelveOpts).Err
+		})
+		res.Attempts += attempts
+		if err != nil {
+			zap.S().Errorf("Failed to unshelve server %s: %v", server.Name, err)
+			return err
 		}
+	}
+
+	zap.S().Infof("Server %s with ID %s is scheduled to awake", server.Name, server.ID)
+	return nil
+}
 
-		// TODO: Can't update metadata immediately after the server is resumed/unshelve
-		// // Update metadata to remove AwakeTimeFilter
-		// updateOpts := servers.MetadataOpts{}
-		// for key, value := range server.NewMetadata {
-		// 	updateOpts[key] = value
-		// }
-		// _, err := servers.UpdateMetadata(ctx, client, server.ID, updateOpts).Extract()
-		// if err != nil {
-		// 	zap.S().Errorf("Failed to update metadata for server %s: %v", server.Name, err)
-		// 	//TODO: Add retry logic
-		// 	continue
-		// }
-		zap.S().Infof("Server %s with ID %s is scheduled to awake", server.Name, server.ID)
+// vmResult returns the result of a VM of this cloud, identifying its region.
+func (c *Cloud) vmResult(name, id, project, status string) result.VMResult {
+	return result.VMResult{
+		Name:           name,
+		ID:             id,
+		Cloud:          c.Name,
+		Region:         c.Region,
+		Project:        project,
+		PreviousStatus: status,
 	}
 }
+
+func (c *Cloud) skippedResult(server servers.Server, reason string) result.VMResult {
+	res := c.vmResult(server.Name, server.ID, c.projectOf(server), server.Status)
+	res.Outcome, res.Reason = result.Skipped, reason
+	return res
+}
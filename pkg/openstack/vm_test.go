@@ -0,0 +1,57 @@
+package openstack
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/platform9/pcd-vm-saver/pkg/clock"
+	"github.com/platform9/pcd-vm-saver/pkg/result"
+)
+
+func TestClaim(t *testing.T) {
+	clk := clock.NewFake(time.Date(2026, 10, 19, 20, 1, 0, 0, time.UTC))
+	metadata := map[string]string{"sleep_zone": "ist"}
+	nova := newFakeNova(clk, fakeServer{ID: "id", Status: "ACTIVE", Metadata: metadata})
+	cloud := newTestCloud(t, nova)
+	ctx := context.Background()
+
+	var sleep, awake result.VMResult
+	release, ok := cloud.claim(ctx, clk, "id", "ACTIVE", metadata, &sleep)
+	if !ok {
+		t.Fatalf("first claim failed: %s", sleep.Reason)
+	}
+
+	// The other job leaves the server alone while it is held
+	if _, ok := cloud.claim(ctx, clk, "id", "ACTIVE", metadata, &awake); ok {
+		t.Fatal("server claimed twice")
+	}
+	if awake.Outcome != result.Skipped {
+		t.Errorf("outcome %s, want %s", awake.Outcome, result.Skipped)
+	}
+
+	// Once released the server is re-fetched by the inventory, and can be
+	// claimed again if it did not change
+	release()
+	if !cloud.inventory.stale["id"] {
+		t.Error("released server not marked stale in the inventory")
+	}
+	release, ok = cloud.claim(ctx, clk, "id", "ACTIVE", metadata, &awake)
+	if !ok {
+		t.Fatalf("claim after release failed: %s", awake.Reason)
+	}
+	release()
+
+	// A changed server is released at once
+	nova.update("id", "SHELVED_OFFLOADED")
+	var res result.VMResult
+	if _, ok := cloud.claim(ctx, clk, "id", "ACTIVE", metadata, &res); ok {
+		t.Fatal("changed server claimed")
+	}
+	if res.Outcome != result.Skipped || res.Reason != "server is now SHELVED_OFFLOADED" {
+		t.Errorf("outcome %s: %s, want skipped as changed", res.Outcome, res.Reason)
+	}
+	if cloud.inFlight["id"] {
+		t.Error("changed server still held")
+	}
+}
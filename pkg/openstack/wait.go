@@ -0,0 +1,86 @@
+package openstack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/platform9/pcd-vm-saver/pkg/clock"
+	"go.uber.org/zap"
+)
+
+const (
+	waitInitialBackoff = 5 * time.Second
+	waitMaxBackoff     = 60 * time.Second
+)
+
+// ErrWaitTimeout is returned by WaitForStatus when the server did not reach any
+// of the target states in time.
+var ErrWaitTimeout = errors.New("timed out waiting for server status")
+
+// StatusError is returned by WaitForStatus when the server lands in one of the
+// fail states.
+type StatusError struct {
+	ID     string
+	Status string
+	Fault  string
+}
+
+func (e *StatusError) Error() string {
+	if e.Fault != "" {
+		return fmt.Sprintf("server %s went to %s: %s", e.ID, e.Status, e.Fault)
+	}
+	return fmt.Sprintf("server %s went to %s", e.ID, e.Status)
+}
+
+// WaitForStatus polls the server with exponential backoff until its status is
+// one of targets with no task in progress, one of failStates, the server is
+// deleted or the timeout expires. The last fetched server is returned in all
+// cases, it is nil if it could never be fetched.
+func (c *Cloud) WaitForStatus(ctx context.Context, clk clock.Clock, id string, targets, failStates []string, timeout time.Duration) (*servers.Server, error) {
+	deadline := clk.Now().Add(timeout)
+	backoff := waitInitialBackoff
+	var server *servers.Server
+	var lastErr error
+
+	for {
+		current, err := servers.Get(ctx, c.compute, id).Extract()
+		if gophercloud.ResponseCodeIs(err, http.StatusNotFound) {
+			return server, fmt.Errorf("server %s is gone: %w", id, err)
+		}
+		if err != nil {
+			// Keep polling, the API might be briefly unavailable.
+			zap.S().Warnf("Failed to get server %s while waiting for %v: %v", id, targets, err)
+			lastErr = err
+		} else {
+			server = current
+			if slices.Contains(targets, server.Status) && server.TaskState == "" {
+				return server, nil
+			}
+			if slices.Contains(failStates, server.Status) {
+				return server, &StatusError{ID: id, Status: server.Status, Fault: server.Fault.Message}
+			}
+			zap.S().Debugf("Server %s is in %s state (task state %q), waiting for %v", id, server.Status, server.TaskState, targets)
+		}
+
+		remaining := deadline.Sub(clk.Now())
+		if remaining <= 0 {
+			if server == nil {
+				return nil, fmt.Errorf("%w: %v", ErrWaitTimeout, lastErr)
+			}
+			return server, fmt.Errorf("%w: last status %s", ErrWaitTimeout, server.Status)
+		}
+
+		select {
+		case <-ctx.Done():
+			return server, ctx.Err()
+		case <-clk.After(min(backoff, remaining)):
+		}
+		backoff = min(backoff*2, waitMaxBackoff)
+	}
+}
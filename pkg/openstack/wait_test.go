@@ -0,0 +1,158 @@
+package openstack
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/platform9/pcd-vm-saver/pkg/clock"
+)
+
+func TestWaitForStatus(t *testing.T) {
+	notFound := fakeResponse{http.StatusNotFound, `{"itemNotFound": {"code": 404, "message": "Instance could not be found."}}`}
+	unavailable := fakeResponse{http.StatusServiceUnavailable, `{}`}
+
+	tests := []struct {
+		name      string
+		responses []fakeResponse
+		status    string // of the server returned, empty when nil
+		err       error  // wrapped by the error returned
+		errText   string // substring of the error returned
+		calls     int
+	}{
+		{
+			name:      "already there",
+			responses: []fakeResponse{serverResponse("id", "SHELVED_OFFLOADED", "")},
+			status:    "SHELVED_OFFLOADED",
+			calls:     1,
+		},
+		{
+			name: "reaches a target",
+			responses: []fakeResponse{
+				serverResponse("id", "ACTIVE", "shelving"),
+				serverResponse("id", "SHELVED", "shelving_offloading"),
+				serverResponse("id", "SHELVED_OFFLOADED", ""),
+			},
+			status: "SHELVED_OFFLOADED",
+			calls:  3,
+		},
+		{
+			name:      "not offloaded",
+			responses: []fakeResponse{serverResponse("id", "ACTIVE", "shelving"), serverResponse("id", "SHELVED", "")},
+			status:    "SHELVED",
+			calls:     2,
+		},
+		{
+			name:      "task in progress",
+			responses: []fakeResponse{serverResponse("id", "SHELVED_OFFLOADED", "spawning")},
+			status:    "SHELVED_OFFLOADED",
+			err:       ErrWaitTimeout,
+		},
+		{
+			name:      "ERROR",
+			responses: []fakeResponse{serverResponse("id", "ACTIVE", "shelving"), serverResponse("id", "ERROR", "")},
+			status:    "ERROR",
+			errText:   "went to ERROR",
+			calls:     2,
+		},
+		{
+			name:      "timeout",
+			responses: []fakeResponse{serverResponse("id", "ACTIVE", "")},
+			status:    "ACTIVE",
+			err:       ErrWaitTimeout,
+		},
+		{
+			name:      "API briefly unavailable",
+			responses: []fakeResponse{unavailable, serverResponse("id", "SUSPENDED", "")},
+			status:    "SUSPENDED",
+			calls:     2,
+		},
+		{
+			name:      "never fetched",
+			responses: []fakeResponse{unavailable},
+			err:       ErrWaitTimeout,
+		},
+		{
+			name:      "deleted while waiting",
+			responses: []fakeResponse{serverResponse("id", "ACTIVE", "shelving"), notFound},
+			status:    "ACTIVE",
+			errText:   "gone",
+			calls:     2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seq := &sequence{responses: tt.responses}
+			cloud := newTestCloud(t, seq)
+			start := time.Date(2026, 10, 19, 20, 1, 0, 0, time.UTC)
+			clk := clock.NewFake(start)
+
+			var server *servers.Server
+			var err error
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				server, err = cloud.WaitForStatus(context.Background(), clk, "id",
+					[]string{"SHELVED_OFFLOADED", "SHELVED", "SUSPENDED"}, []string{"ERROR"}, 10*time.Minute)
+			}()
+			drive(clk, done, waitMaxBackoff)
+
+			switch {
+			case tt.err == nil && tt.errText == "" && err != nil:
+				t.Fatalf("err = %v, want none", err)
+			case tt.err != nil && !errors.Is(err, tt.err):
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			case tt.errText != "" && (err == nil || !strings.Contains(err.Error(), tt.errText)):
+				t.Fatalf("err = %v, want it to contain %q", err, tt.errText)
+			}
+			switch {
+			case server == nil && tt.status != "":
+				t.Errorf("server = nil, want status %s", tt.status)
+			case server != nil && server.Status != tt.status:
+				t.Errorf("server status = %s, want %s", server.Status, tt.status)
+			}
+			if tt.calls > 0 && seq.count() != tt.calls {
+				t.Errorf("%d GET requests, want %d", seq.count(), tt.calls)
+			}
+			if errors.Is(err, ErrWaitTimeout) && clk.Now().Sub(start) < 10*time.Minute {
+				t.Errorf("timed out after %s, want 10m", clk.Now().Sub(start))
+			}
+		})
+	}
+}
+
+func TestWaitForStatusBackoff(t *testing.T) {
+	start := time.Date(2026, 10, 19, 20, 1, 0, 0, time.UTC)
+	clk := clock.NewFake(start)
+	seq := &sequence{responses: []fakeResponse{serverResponse("id", "ACTIVE", "")}}
+	var mu sync.Mutex
+	var polls []time.Duration
+	cloud := newTestCloud(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		polls = append(polls, clk.Now().Sub(start))
+		mu.Unlock()
+		seq.ServeHTTP(w, r)
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cloud.WaitForStatus(context.Background(), clk, "id", []string{"SHELVED_OFFLOADED"}, nil, 4*time.Minute)
+	}()
+	drive(clk, done, time.Second)
+
+	// 5s, 10s, 20s, 40s, then capped at 60s until the deadline
+	mu.Lock()
+	defer mu.Unlock()
+	want := []time.Duration{0, 5 * time.Second, 15 * time.Second, 35 * time.Second, 75 * time.Second, 135 * time.Second, 195 * time.Second, 4 * time.Minute}
+	if !slices.Equal(polls, want) {
+		t.Errorf("polled at %v, want %v", polls, want)
+	}
+}
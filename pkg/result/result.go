@@ -0,0 +1,157 @@
+package result
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Outcome of a sleep/awake run for a single VM.
+type Outcome string
+
+const (
+	Skipped Outcome = "skipped"
+	Acted   Outcome = "acted"
+	Failed  Outcome = "failed"
+	// The VM is in a state pcd-vm-saver can't handle, e.g. ERROR, and needs an operator
+	NeedsAttention Outcome = "needs_attention"
+	// Dry run, the action would have been taken
+	Planned Outcome = "planned"
+)
+
+// VMResult is the per-VM outcome of a sleep/awake run.
+type VMResult struct {
+	Name           string        `json:"name"`
+	ID             string        `json:"id"`
+	Cloud          string        `json:"cloud,omitempty"`
+	Region         string        `json:"region,omitempty"`
+	Project        string        `json:"project,omitempty"`
+	Action         string        `json:"action,omitempty"` // shelve, suspend, unshelve or resume
+	Outcome        Outcome       `json:"outcome"`
+	Reason         string        `json:"reason,omitempty"`
+	PreviousStatus string        `json:"previous_status,omitempty"`
+	NewStatus      string        `json:"new_status,omitempty"`
+	Attempts       int           `json:"attempts,omitempty"` // API calls made to apply the action, including retries
+	Duration       time.Duration `json:"duration,omitempty"`
+}
+
+// Quota is the compute quota usage of the project.
+type Quota struct {
+	VCPUsInUse int `json:"vcpus_in_use"`
+	VCPUsLimit int `json:"vcpus_limit"`
+	RAMInUse   int `json:"ram_in_use"`
+	RAMLimit   int `json:"ram_limit"`
+}
+
+// RunResult is the outcome of one sleep or awake run for one project of a cloud.
+type RunResult struct {
+	Kind        string     `json:"kind"` // sleep or awake
+	Cloud       string     `json:"cloud,omitempty"`
+	Region      string     `json:"region,omitempty"`
+	Project     string     `json:"project,omitempty"`
+	StartedAt   time.Time  `json:"started_at"`
+	FinishedAt  time.Time  `json:"finished_at"`
+	QuotaBefore *Quota     `json:"quota_before,omitempty"`
+	QuotaAfter  *Quota     `json:"quota_after,omitempty"`
+	VMs         []VMResult `json:"vms"`
+}
+
+// Count returns the number of VMs with the given outcome.
+func (r *RunResult) Count(outcome Outcome) int {
+	n := 0
+	for _, vm := range r.VMs {
+		if vm.Outcome == outcome {
+			n++
+		}
+	}
+	return n
+}
+
+// PartialFailure reports whether the action failed for at least one VM.
+func (r *RunResult) PartialFailure() bool {
+	return r.Count(Failed) > 0
+}
+
+// String renders the result as a human readable report, used for Slack and the CLI.
+func (r *RunResult) String() string {
+	var b strings.Builder
+	if len(r.VMs) == 0 {
+		fmt.Fprintf(&b, "No VMs found to %s\n", r.Kind)
+		return b.String()
+	}
+
+	if planned := r.Count(Planned); planned > 0 {
+		fmt.Fprintf(&b, "Dry run, %d planned\n", planned)
+	}
+	fmt.Fprintf(&b, "Auto %s run: %d acted, %d failed, %d skipped, %d need attention (took %s)\n",
+		r.Kind, r.Count(Acted), r.Count(Failed), r.Count(Skipped), r.Count(NeedsAttention), r.FinishedAt.Sub(r.StartedAt).Round(time.Second))
+	if r.Cloud != "" {
+		fmt.Fprintf(&b, "Cloud: %s (region %s)\n", r.Cloud, r.Region)
+	}
+	if r.Project != "" {
+		fmt.Fprintf(&b, "Project: %s\n", r.Project)
+	}
+	b.WriteString("\n")
+
+	if r.QuotaBefore != nil {
+		b.WriteString("Quota before operations:\n")
+		writeQuota(&b, r.QuotaBefore)
+	}
+
+	for _, vm := range r.VMs {
+		switch vm.Outcome {
+		case Acted:
+			fmt.Fprintf(&b, "VM %s (ID: %s) - %s: %s -> %s in %s\n", vm.Name, vm.ID, vm.Action, vm.PreviousStatus, vm.NewStatus, vm.Duration.Round(time.Second))
+		case Failed:
+			fmt.Fprintf(&b, "VM %s (ID: %s) - %s failed after %d attempt(s): %s\n", vm.Name, vm.ID, vm.Action, vm.Attempts, vm.Reason)
+		case Skipped:
+			fmt.Fprintf(&b, "VM %s (ID: %s) - skipped: %s\n", vm.Name, vm.ID, vm.Reason)
+		case NeedsAttention:
+			fmt.Fprintf(&b, "VM %s (ID: %s) - needs attention: %s\n", vm.Name, vm.ID, vm.Reason)
+		case Planned:
+			fmt.Fprintf(&b, "VM %s (ID: %s) - would %s: %s\n", vm.Name, vm.ID, vm.Action, vm.Reason)
+		}
+	}
+
+	if r.QuotaAfter != nil {
+		b.WriteString("\nQuota after operations:\n")
+		writeQuota(&b, r.QuotaAfter)
+	}
+	return b.String()
+}
+
+// Freed returns the vCPUs and RAM released by the run, zero when the quotas are unknown.
+func (r *RunResult) Freed() (vcpus, ram int) {
+	if r.QuotaBefore == nil || r.QuotaAfter == nil {
+		return 0, 0
+	}
+	return r.QuotaBefore.VCPUsInUse - r.QuotaAfter.VCPUsInUse, r.QuotaBefore.RAMInUse - r.QuotaAfter.RAMInUse
+}
+
+// Summary aggregates the results of a run across all the clouds and projects.
+func Summary(results []*RunResult) string {
+	var acted, failed, skipped, attention, vcpus, ram int
+	clouds := map[string]bool{}
+	for _, r := range results {
+		acted += r.Count(Acted)
+		failed += r.Count(Failed)
+		skipped += r.Count(Skipped)
+		attention += r.Count(NeedsAttention)
+		freedVCPUs, freedRAM := r.Freed()
+		vcpus += freedVCPUs
+		ram += freedRAM
+		clouds[r.Cloud] = true
+	}
+
+	summary := fmt.Sprintf("Across %d cloud(s) and %d project(s): %d acted, %d failed, %d skipped, %d need attention",
+		len(clouds), len(results), acted, failed, skipped, attention)
+	if vcpus != 0 || ram != 0 {
+		summary += fmt.Sprintf("\nFreed: %d cores, %d MB RAM", vcpus, ram)
+	}
+	return summary
+}
+
+func writeQuota(b *strings.Builder, q *Quota) {
+	fmt.Fprintf(b, "Cores: %d / %d\n", q.VCPUsInUse, q.VCPUsLimit)
+	fmt.Fprintf(b, "RAM: %d / %d\n", q.RAMInUse, q.RAMLimit)
+}
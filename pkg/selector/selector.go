@@ -0,0 +1,183 @@
+// Package selector implements label selectors matched against the metadata
+// and tags of a server, e.g. "env in (dev,test), team=qa, !critical".
+//
+// A selector is a comma separated list of requirements, all of which must be
+// met:
+//
+//	key              the key exists
+//	!key             the key does not exist
+//	key=value        the key has the value, "==" is accepted too
+//	key!=value       the key does not have the value (or does not exist)
+//	key in (a,b)     the key has one of the values
+//	key notin (a,b)  the key has none of the values (or does not exist)
+//
+// The space before the parentheses is optional, "key in(a,b)" is accepted.
+package selector
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+type operator string
+
+const (
+	exists       operator = "exists"
+	doesNotExist operator = "!"
+	equals       operator = "="
+	notEquals    operator = "!="
+	in           operator = "in"
+	notIn        operator = "notin"
+)
+
+type requirement struct {
+	key    string
+	op     operator
+	values []string
+}
+
+// Selector is a parsed label selector. The zero value matches everything.
+type Selector struct {
+	requirements []requirement
+	text         string
+}
+
+// Parse parses a selector, an empty selector matches everything.
+func Parse(text string) (Selector, error) {
+	sel := Selector{text: strings.TrimSpace(text)}
+	parts, err := split(sel.text)
+	if err != nil {
+		return sel, err
+	}
+	for _, part := range parts {
+		req, err := parseRequirement(part)
+		if err != nil {
+			return sel, fmt.Errorf("invalid selector %q: %w", text, err)
+		}
+		sel.requirements = append(sel.requirements, req)
+	}
+	return sel, nil
+}
+
+// Matches reports whether the labels meet all the requirements.
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, req := range s.requirements {
+		value, ok := labels[req.key]
+		var met bool
+		switch req.op {
+		case exists:
+			met = ok
+		case doesNotExist:
+			met = !ok
+		case equals:
+			met = ok && value == req.values[0]
+		case notEquals:
+			met = !ok || value != req.values[0]
+		case in:
+			met = ok && slices.Contains(req.values, value)
+		case notIn:
+			met = !ok || !slices.Contains(req.values, value)
+		}
+		if !met {
+			return false
+		}
+	}
+	return true
+}
+
+// Empty reports whether the selector has no requirement.
+func (s Selector) Empty() bool {
+	return len(s.requirements) == 0
+}
+
+func (s Selector) String() string {
+	return s.text
+}
+
+// split splits the selector on the commas that are not within parentheses.
+func split(text string) ([]string, error) {
+	var parts []string
+	depth, start := 0, 0
+	for i, r := range text {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("invalid selector %q: unbalanced parentheses", text)
+			}
+		case ',':
+			if depth == 0 {
+				parts = append(parts, text[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("invalid selector %q: unbalanced parentheses", text)
+	}
+	if last := text[start:]; strings.TrimSpace(last) != "" || len(parts) > 0 {
+		parts = append(parts, last)
+	}
+	return parts, nil
+}
+
+func parseRequirement(text string) (requirement, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return requirement{}, fmt.Errorf("empty requirement")
+	}
+
+	if key, ok := strings.CutPrefix(text, "!"); ok {
+		return newRequirement(key, doesNotExist, nil)
+	}
+	if key, value, ok := strings.Cut(text, "!="); ok {
+		return newRequirement(key, notEquals, []string{value})
+	}
+	if key, value, ok := strings.Cut(text, "=="); ok {
+		return newRequirement(key, equals, []string{value})
+	}
+	if key, value, ok := strings.Cut(text, "="); ok {
+		return newRequirement(key, equals, []string{value})
+	}
+
+	// The values may follow the operator without a space, e.g. "env in(dev,test)"
+	open := strings.IndexByte(text, '(')
+	if open < 0 {
+		open = len(text)
+	}
+	fields := strings.Fields(text[:open])
+	if len(fields) == 1 && open == len(text) {
+		return newRequirement(fields[0], exists, nil)
+	}
+	if len(fields) < 2 || (fields[1] != string(in) && fields[1] != string(notIn)) {
+		return requirement{}, fmt.Errorf("unexpected requirement %q", text)
+	}
+	set := strings.TrimSpace(strings.Join(fields[2:], " ") + text[open:])
+	if !strings.HasPrefix(set, "(") || !strings.HasSuffix(set, ")") {
+		return requirement{}, fmt.Errorf("values of %q must be within parentheses", text)
+	}
+	var values []string
+	for _, value := range strings.Split(set[1:len(set)-1], ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	if len(values) == 0 {
+		return requirement{}, fmt.Errorf("no values in %q", text)
+	}
+	return newRequirement(fields[0], operator(fields[1]), values)
+}
+
+func newRequirement(key string, op operator, values []string) (requirement, error) {
+	key = strings.TrimSpace(key)
+	if key == "" || strings.ContainsAny(key, " ()!=") {
+		return requirement{}, fmt.Errorf("invalid key %q", key)
+	}
+	for i := range values {
+		values[i] = strings.TrimSpace(values[i])
+	}
+	return requirement{key: key, op: op, values: values}, nil
+}
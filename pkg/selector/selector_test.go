@@ -0,0 +1,107 @@
+package selector
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		err  string // substring of the error, empty when valid
+	}{
+		{"empty", "", ""},
+		{"blank", "   ", ""},
+		{"exists", "critical", ""},
+		{"does not exist", "!critical", ""},
+		{"equals", "env=dev", ""},
+		{"double equals", "env==dev", ""},
+		{"not equals", "env!=prod", ""},
+		{"in", "env in (dev,test)", ""},
+		{"notin", "env notin (prod)", ""},
+		{"in without a space", "env in(dev,test)", ""},
+		{"notin without a space", "env notin(prod)", ""},
+		{"several", "env in (dev, test), team=qa, !critical", ""},
+		{"unbalanced open", "env in (dev,test", "unbalanced parentheses"},
+		{"unbalanced close", "env in dev,test)", "unbalanced parentheses"},
+		{"empty requirement", "env=dev,,team=qa", "empty requirement"},
+		{"trailing comma", "env=dev,", "empty requirement"},
+		{"leading comma", ",env=dev", "empty requirement"},
+		{"empty key", "=dev", "invalid key"},
+		{"empty not key", "!", "invalid key"},
+		{"no values", "env in ()", "no values"},
+		{"values without parentheses", "env in dev", "within parentheses"},
+		{"trailing text", "env in (dev) test", "within parentheses"},
+		{"unknown operator", "env within (dev)", "unexpected requirement"},
+		{"no operator", "env (dev)", "unexpected requirement"},
+		{"key with spaces", "my env=dev", "invalid key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.text)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("Parse(%q): %v", tt.text, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Parse(%q) error = %v, want it to contain %q", tt.text, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMatches(t *testing.T) {
+	labels := map[string]string{"env": "dev", "team": "qa", "critical": ""}
+	tests := []struct {
+		text    string
+		matches bool
+	}{
+		{"", true},
+		{"env", true},
+		{"owner", false},
+		{"!owner", true},
+		{"!critical", false},
+		{"env=dev", true},
+		{"env==dev", true},
+		{"env=prod", false},
+		{"owner=", false},
+		{"critical=", true},
+		{"env!=prod", true},
+		{"env!=dev", false},
+		{"owner!=x", true},
+		{"env in (dev,test)", true},
+		{"env in(test,prod)", false},
+		{"owner in (x)", false},
+		{"env notin (prod)", true},
+		{"env notin(dev)", false},
+		{"owner notin (x)", true},
+		{"env in (dev), team=qa", true},
+		{"env in (dev), team=ops", false},
+		{"env in (dev, test) , !owner , team", true},
+	}
+
+	for _, tt := range tests {
+		sel, err := Parse(tt.text)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.text, err)
+		}
+		if got := sel.Matches(labels); got != tt.matches {
+			t.Errorf("%q matches = %t, want %t", tt.text, got, tt.matches)
+		}
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	var zero Selector
+	if !zero.Empty() || !zero.Matches(map[string]string{"env": "dev"}) {
+		t.Error("the zero selector must be empty and match everything")
+	}
+	sel, err := Parse("  ")
+	if err != nil || !sel.Empty() {
+		t.Errorf("Parse(blank) = %v, %v, want an empty selector", sel, err)
+	}
+}
@@ -17,9 +17,55 @@ const (
 
 	OverrideSleepFilter = "save_sleep"
 
+	// What to do when a user wakes the VM up during its sleep window: "window" leaves it
+	// awake until the window ends (default), "none" puts it back to sleep, or a number of hours
+	ManualWakeGraceFilter = "manual_wake_grace"
+
 	SleepModeFilter = "ram_preserve" // Consider Suspend instead of Shelve VM
 	AwakeTimeFilter = "awake_time"   // Metadata key to store awake time for the VM
+	LastAwakeFilter = "last_awake"   // Metadata key archiving when the VM was last awakened
+
+	StateFilter      = "vmsaver_state"       // Metadata key to store the lifecycle state of the VM
+	StateSinceFilter = "vmsaver_state_since" // Metadata key to store when the VM entered its state
+
+	// Ownership marker, only the VMs slept by pcd-vm-saver are awakened
+	SleptAtFilter     = "vmsaver_slept_at" // Metadata key to store when pcd-vm-saver put the VM to sleep
+	SleptActionFilter = "vmsaver_action"   // Metadata key to store the sleep action taken, shelve or suspend
+
+	LockedFilter = "vmsaver_locked" // Metadata key marking the VMs locked by pcd-vm-saver while asleep
+
+	PriorStatusFilter = "vmsaver_prior_status" // Metadata key to store the status of the VM before sleep
+
+)
+
+// Concurrency and API rate limit settings, overridable through environment variables.
+const (
+	// Path of the YAML configuration file listing the clouds to manage
+	ConfigEnv = "VMSAVER_CONFIG"
+
+	WorkersEnv  = "VMSAVER_WORKERS"
+	APIRateEnv  = "VMSAVER_API_RATE"
+	APIBurstEnv = "VMSAVER_API_BURST"
+
+	// Comma separated Nova tags, only servers carrying one of them are considered
+	OptInTagsEnv = "VMSAVER_OPT_IN_TAGS"
+
+	// Admin mode, manage all the projects or a comma separated list of project IDs
+	AllTenantsEnv = "VMSAVER_ALL_TENANTS"
+	ProjectsEnv   = "VMSAVER_PROJECTS"
+
+	// Lock the VMs in Nova while they are asleep
+	LockEnv = "VMSAVER_LOCK"
+
+	// Shelve the powered off VMs too, they are powered off again when awakened
+	ShelveShutoffEnv = "VMSAVER_SHELVE_SHUTOFF"
+
+	// Until this RFC3339 time, awaken the VMs slept by releases without the ownership marker
+	AdoptLegacyUntilEnv = "VMSAVER_ADOPT_LEGACY_UNTIL"
 
+	DefaultWorkers  = 10
+	DefaultAPIRate  = 5.0 // requests per second
+	DefaultAPIBurst = 10
 )
 
 // Logger Variables.
@@ -2,38 +2,36 @@ package vmpoll
 
 import (
 	"context"
-	"fmt"
-	"time"
 
+	"github.com/platform9/pcd-vm-saver/pkg/clock"
 	"github.com/platform9/pcd-vm-saver/pkg/openstack"
+	"github.com/platform9/pcd-vm-saver/pkg/result"
 	"go.uber.org/zap"
 )
 
-func AutoAwakeVM() (string, error) {
+// AutoAwakeVM unshelves/resumes all the VMs whose awake time has passed and
+// returns one RunResult per project. The returned error is only set when the
+// run could not be performed at all, failures of individual VMs are reported
+// in the results.
+func AutoAwakeVM(cloud *openstack.Cloud, clk clock.Clock) ([]*result.RunResult, error) {
 	zap.S().Infof("Triggering auto awake VMs")
 	ctx := context.TODO()
+	runs := newProjectRuns("awake", cloud, clk.Now())
 
 	// Fetch all VMs to Awake
-	awakeVms := openstack.GetVMsToAwake(ctx)
+	awakeVms, skipped, err := cloud.GetVMsToAwake(ctx, clk)
+	if err != nil {
+		return nil, err
+	}
+	runs.add(skipped...)
 
 	if len(awakeVms) == 0 {
 		zap.S().Info("No VMs found to awake")
-		return "No VMs found to awake", nil
+		return runs.list(clk.Now()), nil
 	}
 
-	// Awake by SleepMode UnShelve or Resume
-	openstack.AwakeVMs(ctx, awakeVms)
-
-	time.Sleep(25 * time.Second) // Adding a minimum wait time to ensure VMs are awake
-
-	// Build success message with list of awakened VMs
-	successMsg := "AutoAwakeVM task completed successfully\n\n"
-	successMsg += "List of VMs awakened:\n"
-
-	for _, vm := range awakeVms {
-		vmStatus := openstack.GetVMStatus(ctx, vm.ID)
-		successMsg += fmt.Sprintf("VM %s (ID: %s) - Current state: %s\n", vm.Name, vm.ID, vmStatus.Status)
-	}
+	// Awake by SleepMode UnShelve or Resume and wait for them to become ACTIVE
+	runs.add(cloud.AwakeVMs(ctx, clk, awakeVms)...)
 
-	return successMsg, nil
+	return runs.list(clk.Now()), nil
 }
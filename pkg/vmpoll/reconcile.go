@@ -0,0 +1,30 @@
+package vmpoll
+
+import (
+	"context"
+
+	"github.com/platform9/pcd-vm-saver/pkg/clock"
+	"github.com/platform9/pcd-vm-saver/pkg/openstack"
+	"github.com/platform9/pcd-vm-saver/pkg/result"
+	"go.uber.org/zap"
+)
+
+// Reconcile resumes the sleep/awake transitions interrupted by a restart and
+// returns one RunResult per project. It is run once at startup, before the
+// scheduled jobs, and before the jobs of a single pass with the transitions
+// of these jobs only.
+func Reconcile(opts openstack.ReconcileOpts) func(*openstack.Cloud, clock.Clock) ([]*result.RunResult, error) {
+	return func(cloud *openstack.Cloud, clk clock.Clock) ([]*result.RunResult, error) {
+		zap.S().Infof("Reconciling VM states")
+		ctx := context.TODO()
+		runs := newProjectRuns("reconcile", cloud, clk.Now())
+
+		vms, err := cloud.Reconcile(ctx, clk, opts)
+		if err != nil {
+			return nil, err
+		}
+		runs.add(vms...)
+
+		return runs.list(clk.Now()), nil
+	}
+}
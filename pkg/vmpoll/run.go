@@ -0,0 +1,99 @@
+package vmpoll
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/platform9/pcd-vm-saver/pkg/clock"
+	"github.com/platform9/pcd-vm-saver/pkg/openstack"
+	"github.com/platform9/pcd-vm-saver/pkg/result"
+	"go.uber.org/zap"
+)
+
+// projectRuns groups the VM results of a run by project, so that quotas and
+// notifications are reported per project.
+type projectRuns struct {
+	kind    string
+	cloud   *openstack.Cloud
+	started time.Time
+	runs    map[string]*result.RunResult
+}
+
+func newProjectRuns(kind string, cloud *openstack.Cloud, started time.Time) *projectRuns {
+	return &projectRuns{kind: kind, cloud: cloud, started: started, runs: map[string]*result.RunResult{}}
+}
+
+func (p *projectRuns) get(project string) *result.RunResult {
+	run, ok := p.runs[project]
+	if !ok {
+		run = &result.RunResult{Kind: p.kind, Cloud: p.cloud.Name, Region: p.cloud.Region, Project: project, StartedAt: p.started}
+		p.runs[project] = run
+	}
+	return run
+}
+
+func (p *projectRuns) add(vms ...result.VMResult) {
+	for _, vm := range vms {
+		run := p.get(vm.Project)
+		run.VMs = append(run.VMs, vm)
+	}
+}
+
+// list returns the results sorted by project. A single empty result is
+// returned when no VM was considered at all.
+func (p *projectRuns) list(finished time.Time) []*result.RunResult {
+	if len(p.runs) == 0 {
+		p.get("")
+	}
+	list := make([]*result.RunResult, 0, len(p.runs))
+	for _, run := range p.runs {
+		run.FinishedAt = finished
+		list = append(list, run)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Project < list[j].Project })
+	return list
+}
+
+// ForClouds runs job on every cloud concurrently and returns all the results.
+// A cloud failing does not prevent the others from running, the errors are
+// returned joined.
+func ForClouds(clouds []*openstack.Cloud, clk clock.Clock, job func(*openstack.Cloud, clock.Clock) ([]*result.RunResult, error)) ([]*result.RunResult, error) {
+	cloudResults := make([][]*result.RunResult, len(clouds))
+	errs := make([]error, len(clouds))
+	var wg sync.WaitGroup
+	for i, cloud := range clouds {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cloudResults[i], errs[i] = job(cloud, clk)
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("cloud %s: %w", cloud.Name, errs[i])
+			}
+		}()
+	}
+	wg.Wait()
+
+	var results []*result.RunResult
+	for _, res := range cloudResults {
+		results = append(results, res...)
+	}
+	return results, errors.Join(errs...)
+}
+
+func quota(ctx context.Context, cloud *openstack.Cloud, project string) *result.Quota {
+	metrics, err := cloud.Quotas(ctx, project)
+	if err != nil {
+		zap.S().Errorf("Failed to fetch quotas: %v", err)
+		return nil
+	}
+	return &result.Quota{
+		VCPUsInUse: metrics.VCPUsInUse,
+		VCPUsLimit: metrics.VCPUsLimit,
+		RAMInUse:   metrics.RAMInUse,
+		RAMLimit:   metrics.RAMLimit,
+	}
+}